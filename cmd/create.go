@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -10,7 +11,7 @@ import (
 )
 
 // createSnapshot creates a new snapshot of the specified blockchain node
-func createSnapshot(cfg *config.Config, logger *zap.Logger, nodeName string) error {
+func createSnapshot(ctx context.Context, cfg *config.Config, logger *zap.Logger, nodeName, output string, compress, verify, requireMetadata bool) error {
 	// Get node configuration
 	nodeCfg, err := cfg.GetNodeConfig(nodeName)
 	if err != nil {
@@ -31,12 +32,33 @@ func createSnapshot(cfg *config.Config, logger *zap.Logger, nodeName string) err
 	snapshotSvc := snapshot.NewService(nodeCfg, logger)
 
 	// Create snapshot
-	snapshotPath, err := snapshotSvc.Create()
+	snapshotPath, err := snapshotSvc.Create(ctx, snapshot.CreateOptions{
+		OutputPath:      output,
+		Uncompressed:    !compress,
+		RequireMetadata: requireMetadata,
+	})
 	if err != nil {
 		logger.Error("Failed to create snapshot", zap.Error(err))
 		return fmt.Errorf("failed to create snapshot: %w", err)
 	}
 
+	// Verify snapshot
+	if verify {
+		if err := snapshotSvc.Verify(ctx, snapshotPath); err != nil {
+			logger.Error("Snapshot verification failed",
+				zap.String("path", snapshotPath),
+				zap.Error(err))
+
+			// Don't leave a corrupt archive behind for the catalog and uploads to pick up
+			if removeErr := snapshotSvc.Remove(snapshotPath); removeErr != nil {
+				logger.Warn("Failed to remove corrupt snapshot",
+					zap.String("path", snapshotPath),
+					zap.Error(removeErr))
+			}
+			return fmt.Errorf("snapshot verification failed: %w", err)
+		}
+	}
+
 	logger.Info("Snapshot created successfully",
 		zap.String("node", nodeName),
 		zap.String("path", snapshotPath),
@@ -2,34 +2,53 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/q163i/snapshot-cosmos/internal/config"
 	"github.com/q163i/snapshot-cosmos/internal/daemon"
 	"go.uber.org/zap"
 )
 
-// runDaemon runs the snapshot daemon service for the specified node
-func runDaemon(cfg *config.Config, logger *zap.Logger, nodeName string) error {
-	// Get node configuration
-	nodeCfg, err := cfg.GetNodeConfig(nodeName)
-	if err != nil {
-		return fmt.Errorf("failed to get node configuration: %w", err)
-	}
+// runDaemon runs the snapshot daemon services for the specified nodes in one
+// process. Each node keeps its own schedule, archive jobs and uploads share the
+// process limits.
+func runDaemon(ctx context.Context, cfg *config.Config, logger *zap.Logger, nodeNames []string, listenAddr string) error {
+	limits := daemon.NewLimits(cfg.Daemon.MaxConcurrentArchives, cfg.Daemon.MaxConcurrentUploads)
+
+	// Create a daemon service per node
+	var services []*daemon.Service
+	seen := map[string]bool{}
+	for _, nodeName := range nodeNames {
+		if seen[nodeName] {
+			return fmt.Errorf("node %s is given more than once", nodeName)
+		}
+		seen[nodeName] = true
 
-	logger.Info("Starting snapshot daemon",
-		zap.String("node", nodeName),
-		zap.String("chain_id", nodeCfg.Node.ChainID),
-		zap.Duration("interval", nodeCfg.Snapshot.Interval))
+		nodeCfg, err := cfg.GetNodeConfig(nodeName)
+		if err != nil {
+			return fmt.Errorf("failed to get node configuration: %w", err)
+		}
 
-	// Create daemon service
-	daemonSvc := daemon.NewService(nodeCfg, logger)
+		logger.Info("Starting snapshot daemon",
+			zap.String("node", nodeName),
+			zap.String("chain_id", nodeCfg.Node.ChainID),
+			zap.Duration("interval", nodeCfg.Snapshot.Interval))
+
+		daemonSvc := daemon.NewService(nodeCfg, logger.With(zap.String("node", nodeName)))
+		daemonSvc.SetLimits(limits)
+		services = append(services, daemonSvc)
+	}
 
 	// Create context with cancellation
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// Handle graceful shutdown
@@ -42,13 +61,65 @@ func runDaemon(cfg *config.Config, logger *zap.Logger, nodeName string) error {
 		cancel()
 	}()
 
-	// Run daemon
-	err = daemonSvc.Run(ctx)
+	// Serve the HTTP API and metrics
+	if listenAddr != "" {
+		handler := daemon.NewHandler(services, logger)
+		if err := serveHTTP(ctx, listenAddr, handler, logger); err != nil {
+			return err
+		}
+	}
+
+	// Run daemons, a node that fails to start stops the others
+	errs := make([]error, len(services))
+	var wg sync.WaitGroup
+	for i, daemonSvc := range services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := daemonSvc.Run(ctx); err != nil {
+				logger.Error("Daemon failed", zap.String("node", nodeNames[i]), zap.Error(err))
+				errs[i] = fmt.Errorf("daemon for node %s failed: %w", nodeNames[i], err)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	logger.Info("Daemon stopped gracefully", zap.Strings("nodes", nodeNames))
+	return nil
+}
+
+// serveHTTP serves handler on addr until ctx is cancelled
+func serveHTTP(ctx context.Context, addr string, handler http.Handler, logger *zap.Logger) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Listen before returning so a busy port fails the daemon at startup
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		logger.Error("Daemon failed", zap.Error(err))
-		return fmt.Errorf("daemon failed: %w", err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
-	logger.Info("Daemon stopped gracefully", zap.String("node", nodeName))
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server failed", zap.Error(err))
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("Serving HTTP", zap.String("address", addr))
 	return nil
 }
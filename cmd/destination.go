@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"github.com/q163i/snapshot-cosmos/internal/storage/backend"
+	"go.uber.org/zap"
+)
+
+// openDestination opens the storage of a node's destination called name, or of
+// its first required destination when name is empty
+func openDestination(nodeCfg *config.NodeConfig, name string, logger *zap.Logger) (config.DestinationConfig, storage.Backend, error) {
+	dest, err := nodeCfg.GetDestination(name)
+	if err != nil {
+		return config.DestinationConfig{}, nil, err
+	}
+
+	store, err := backend.NewDestination(nodeCfg, dest, logger)
+	if err != nil {
+		return config.DestinationConfig{}, nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+
+	return dest, store, nil
+}
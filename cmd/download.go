@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"go.uber.org/zap"
+)
+
+// downloadSnapshot downloads a snapshot and its sidecar files from storage
+func downloadSnapshot(ctx context.Context, cfg *config.Config, logger *zap.Logger, nodeName, key, outputDir, destName string) error {
+	// Get node configuration
+	nodeCfg, err := cfg.GetNodeConfig(nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node configuration: %w", err)
+	}
+
+	// Open snapshot storage
+	dest, store, err := openDestination(nodeCfg, destName, logger)
+	if err != nil {
+		return err
+	}
+
+	// Resolve storage key
+	storageKey, err := resolveSnapshotKey(ctx, nodeCfg, dest, store, key)
+	if err != nil {
+		return err
+	}
+
+	if outputDir == "" {
+		outputDir = nodeCfg.GetSnapshotPath()
+	}
+	localPath := filepath.Join(outputDir, path.Base(storageKey))
+
+	// Download snapshot
+	if err := store.Download(ctx, storageKey, localPath); err != nil {
+		logger.Error("Failed to download snapshot", zap.Error(err))
+		return fmt.Errorf("failed to download snapshot: %w", err)
+	}
+
+	// Download sidecars, older snapshots may not have them
+	for _, sidecar := range snapshot.Sidecars(localPath) {
+		sidecarKey := storageKey + strings.TrimPrefix(sidecar, localPath)
+		if err := store.Download(ctx, sidecarKey, sidecar); err != nil {
+			logger.Warn("Failed to download sidecar",
+				zap.String("key", sidecarKey),
+				zap.Error(err))
+		}
+	}
+
+	logger.Info("Snapshot downloaded successfully",
+		zap.String("node", nodeName),
+		zap.String("key", storageKey),
+		zap.String("destination", dest.Name),
+		zap.String("local_path", localPath))
+
+	return nil
+}
@@ -34,8 +34,14 @@ func listNodes(cfg *config.Config, logger *zap.Logger) {
 		fmt.Printf("  RPC Endpoint: %s\n", nodeCfg.Node.RPCEndpoint)
 		fmt.Printf("  Snapshot Interval: %s\n", nodeCfg.Snapshot.Interval)
 		fmt.Printf("  Retention: %d snapshots\n", nodeCfg.Snapshot.Retention)
-		fmt.Printf("  S3 Bucket: %s\n", nodeCfg.S3.Bucket)
-		fmt.Printf("  S3 Path: %s\n", nodeCfg.S3.PathPrefix)
+		fmt.Printf("  Compression: %s\n", nodeCfg.Snapshot.Compression)
+		fmt.Printf("  Storage: %s\n", nodeCfg.Storage.Type)
+		if nodeCfg.Storage.Type == config.StorageLocal {
+			fmt.Printf("  Storage Path: %s\n", nodeCfg.Storage.Path)
+		} else {
+			fmt.Printf("  S3 Bucket: %s\n", nodeCfg.S3.Bucket)
+		}
+		fmt.Printf("  Path Prefix: %s\n", nodeCfg.S3.PathPrefix)
 		fmt.Printf("  Enabled: %t\n", nodeCfg.Enabled)
 	}
 
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/daemon"
+	"go.uber.org/zap"
+)
+
+// pruneSnapshots applies the retention policies of a node and prints every decision
+func pruneSnapshots(ctx context.Context, cfg *config.Config, logger *zap.Logger, nodeName string, dryRun bool) error {
+	// Get node configuration
+	nodeCfg, err := cfg.GetNodeConfig(nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node configuration: %w", err)
+	}
+
+	reports, err := daemon.NewService(nodeCfg, logger).Prune(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+
+	action := "delete"
+	if dryRun {
+		action = "would delete"
+	}
+
+	for _, report := range reports {
+		fmt.Printf("\n%s:\n", report.Target)
+		if len(report.Decisions) == 0 {
+			fmt.Println("  no snapshots")
+			continue
+		}
+
+		for _, decision := range report.Decisions {
+			verb := "keep"
+			if !decision.Keep {
+				verb = action
+			}
+			fmt.Printf("  %-12s %s (%s)\n", verb, decision.Key, decision.Reason)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"go.uber.org/zap"
+)
+
+// restoreSnapshot downloads a snapshot from storage and extracts it into the node data directory
+func restoreSnapshot(ctx context.Context, cfg *config.Config, logger *zap.Logger, nodeName, key, destName string, moveAside bool) error {
+	// Get node configuration
+	nodeCfg, err := cfg.GetNodeConfig(nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node configuration: %w", err)
+	}
+
+	// Create services
+	dest, store, err := openDestination(nodeCfg, destName, logger)
+	if err != nil {
+		return err
+	}
+	snapshotSvc := snapshot.NewService(nodeCfg, logger)
+
+	// Resolve storage key
+	storageKey, err := resolveSnapshotKey(ctx, nodeCfg, dest, store, key)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Starting snapshot restore",
+		zap.String("node", nodeName),
+		zap.String("key", storageKey),
+		zap.String("destination", dest.Name),
+		zap.String("data_path", nodeCfg.GetNodeDataPath()))
+
+	// Make sure we don't overwrite existing data
+	if err := snapshotSvc.CheckDataDir(moveAside); err != nil {
+		return fmt.Errorf("failed to prepare data directory: %w (use --move-aside to keep the existing data)", err)
+	}
+
+	// Stream snapshot from storage
+	body, err := store.Open(ctx, storageKey)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer body.Close()
+
+	// Extract snapshot next to the data directory and swap it in
+	backupPath, err := snapshotSvc.Restore(ctx, body, moveAside)
+	if err != nil {
+		logger.Error("Failed to restore snapshot", zap.Error(err))
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+
+	logger.Info("Snapshot restored successfully",
+		zap.String("node", nodeName),
+		zap.String("key", storageKey),
+		zap.String("data_path", nodeCfg.GetNodeDataPath()),
+		zap.String("previous_data", backupPath))
+
+	return nil
+}
+
+// resolveSnapshotKey turns a snapshot name, full key or "latest" into a storage key at the destination
+func resolveSnapshotKey(ctx context.Context, nodeCfg *config.NodeConfig, dest config.DestinationConfig, store storage.Backend, key string) (string, error) {
+	prefix := fmt.Sprintf("%s/", dest.PathPrefix)
+
+	if key != "" && key != "latest" {
+		if strings.HasPrefix(key, prefix) {
+			return key, nil
+		}
+		return prefix + key, nil
+	}
+
+	// Find the newest snapshot for this chain
+	objects, err := store.List(ctx, prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to list stored snapshots: %w", err)
+	}
+
+	var latestKey string
+	var latest snapshot.Name
+	for _, object := range objects {
+		name, ok := snapshot.ParseName(nodeCfg.Node.ChainID, strings.TrimPrefix(object.Key, prefix))
+		if !ok {
+			continue
+		}
+		if latestKey == "" || latest.Before(name) {
+			latestKey, latest = object.Key, name
+		}
+	}
+
+	if latestKey == "" {
+		return "", fmt.Errorf("no snapshots found under %s", prefix)
+	}
+
+	return latestKey, nil
+}
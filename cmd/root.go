@@ -1,6 +1,12 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"os/signal"
+	"sort"
+	"syscall"
+
 	"github.com/q163i/snapshot-cosmos/internal/config"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -21,11 +27,18 @@ This tool helps maintain regular snapshots of multiple blockchain node data for
 	// Add subcommands
 	rootCmd.AddCommand(newCreateCmd(cfg, logger))
 	rootCmd.AddCommand(newUploadCmd(cfg, logger))
+	rootCmd.AddCommand(newRestoreCmd(cfg, logger))
+	rootCmd.AddCommand(newDownloadCmd(cfg, logger))
 	rootCmd.AddCommand(newDaemonCmd(cfg, logger))
+	rootCmd.AddCommand(newPruneCmd(cfg, logger))
 	rootCmd.AddCommand(newListCmd(cfg, logger))
 	rootCmd.AddCommand(newVersionCmd())
 
-	return rootCmd.Execute()
+	// Cancel the running command on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	return rootCmd.ExecuteContext(ctx)
 }
 
 // newCreateCmd creates the create snapshot command
@@ -36,13 +49,18 @@ func newCreateCmd(cfg *config.Config, logger *zap.Logger) *cobra.Command {
 		Long:  "Create a new snapshot of the specified blockchain node data",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return createSnapshot(cfg, logger, args[0])
+			output, _ := cmd.Flags().GetString("output")
+			compress, _ := cmd.Flags().GetBool("compress")
+			verify, _ := cmd.Flags().GetBool("verify")
+			requireMetadata, _ := cmd.Flags().GetBool("require-metadata")
+			return createSnapshot(cmd.Context(), cfg, logger, args[0], output, compress, verify, requireMetadata)
 		},
 	}
 
-	cmd.Flags().String("output", "", "Output file path (optional)")
+	cmd.Flags().String("output", "", "Output file path, ending in the extension of the compression format (optional)")
 	cmd.Flags().Bool("compress", true, "Enable compression")
 	cmd.Flags().Bool("verify", true, "Verify snapshot integrity")
+	cmd.Flags().Bool("require-metadata", false, "Fail when the node status can't be queried for the snapshot height")
 
 	return cmd
 }
@@ -51,16 +69,66 @@ func newCreateCmd(cfg *config.Config, logger *zap.Logger) *cobra.Command {
 func newUploadCmd(cfg *config.Config, logger *zap.Logger) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "upload [node-name] [file]",
-		Short: "Upload snapshot to S3",
-		Long:  "Upload a snapshot file to S3 storage for the specified node",
+		Short: "Upload snapshot to storage",
+		Long:  "Upload a snapshot file to the S3 or local storage of the specified node",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return uploadSnapshot(cfg, logger, args[0], args[1])
+			destination, _ := cmd.Flags().GetString("destination")
+			return uploadSnapshot(cmd.Context(), cfg, logger, args[0], args[1], destination)
 		},
 	}
 
 	cmd.Flags().String("key", "", "S3 object key (optional)")
 	cmd.Flags().Bool("public", false, "Make object public")
+	cmd.Flags().String("destination", "", "Destination to upload to (defaults to the first required destination)")
+
+	return cmd
+}
+
+// newRestoreCmd creates the restore command
+func newRestoreCmd(cfg *config.Config, logger *zap.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore [node-name] [key|latest]",
+		Short: "Restore snapshot from storage",
+		Long:  "Download a snapshot from storage and extract it into the data directory of the specified node",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key := "latest"
+			if len(args) > 1 {
+				key = args[1]
+			}
+			moveAside, _ := cmd.Flags().GetBool("move-aside")
+			destination, _ := cmd.Flags().GetString("destination")
+			return restoreSnapshot(cmd.Context(), cfg, logger, args[0], key, destination, moveAside)
+		},
+	}
+
+	cmd.Flags().Bool("move-aside", false, "Move a non-empty data directory aside instead of failing")
+	cmd.Flags().String("destination", "", "Destination to restore from (defaults to the first required destination)")
+
+	return cmd
+}
+
+// newDownloadCmd creates the download command
+func newDownloadCmd(cfg *config.Config, logger *zap.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "download [node-name] [key|latest]",
+		Short: "Download snapshot from storage",
+		Long:  "Download a snapshot and its sidecar files from storage into the snapshot directory, resuming an interrupted download",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key := "latest"
+			if len(args) > 1 {
+				key = args[1]
+			}
+			output, _ := cmd.Flags().GetString("output")
+			destination, _ := cmd.Flags().GetString("destination")
+			return downloadSnapshot(cmd.Context(), cfg, logger, args[0], key, output, destination)
+		},
+	}
+
+	cmd.Flags().StringP("output", "o", "", "Output directory (defaults to the node snapshot path)")
+	cmd.Flags().String("destination", "", "Destination to download from (defaults to the first required destination)")
 
 	return cmd
 }
@@ -68,17 +136,52 @@ func newUploadCmd(cfg *config.Config, logger *zap.Logger) *cobra.Command {
 // newDaemonCmd creates the daemon command
 func newDaemonCmd(cfg *config.Config, logger *zap.Logger) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "daemon [node-name]",
+		Use:   "daemon [node-name...]",
 		Short: "Run snapshot daemon",
-		Long:  "Run the snapshot service as a daemon with periodic snapshots for the specified node",
-		Args:  cobra.ExactArgs(1),
+		Long:  "Run the snapshot service as a daemon with periodic snapshots for the specified nodes, or every enabled node with --all",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runDaemon(cfg, logger, args[0])
+			all, _ := cmd.Flags().GetBool("all")
+			nodeNames := args
+			switch {
+			case all && len(args) > 0:
+				return fmt.Errorf("node names cannot be combined with --all")
+			case all:
+				nodeNames = cfg.GetEnabledNodes()
+				sort.Strings(nodeNames)
+			case len(args) == 0:
+				return fmt.Errorf("specify at least one node name or --all")
+			}
+
+			listenAddr := cfg.Server.ListenAddress
+			if cmd.Flags().Changed("listen") {
+				listenAddr, _ = cmd.Flags().GetString("listen")
+			}
+			return runDaemon(cmd.Context(), cfg, logger, nodeNames, listenAddr)
 		},
 	}
 
 	cmd.Flags().Duration("interval", 0, "Snapshot interval (overrides config)")
 	cmd.Flags().Bool("upload", true, "Automatically upload snapshots")
+	cmd.Flags().Bool("all", false, "Run every enabled node")
+	cmd.Flags().String("listen", "", "Address to serve the HTTP API and metrics on, empty to disable (overrides config)")
+
+	return cmd
+}
+
+// newPruneCmd creates the prune command
+func newPruneCmd(cfg *config.Config, logger *zap.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune [node-name]",
+		Short: "Apply retention policies",
+		Long:  "Delete local and stored snapshots of the specified node that its retention policies no longer keep",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			return pruneSnapshots(cmd.Context(), cfg, logger, args[0], dryRun)
+		},
+	}
+
+	cmd.Flags().Bool("dry-run", false, "Print what would be deleted and why without deleting anything")
 
 	return cmd
 }
@@ -4,44 +4,156 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/robfig/cron/v3"
 	"github.com/spf13/viper"
 )
 
 // NodeConfig represents configuration for a single blockchain node
 type NodeConfig struct {
-	Enabled bool `mapstructure:"enabled"`
+	Name    string `mapstructure:"-"` // Set from the nodes map key
+	Enabled bool   `mapstructure:"enabled"`
 	Node    struct {
-		HomeDir     string `mapstructure:"home_dir"`
-		DataDir     string `mapstructure:"data_dir"`
-		ChainID     string `mapstructure:"chain_id"`
-		BinaryPath  string `mapstructure:"binary_path"`
-		RPCEndpoint string `mapstructure:"rpc_endpoint"`
+		HomeDir     string          `mapstructure:"home_dir"`
+		DataDir     string          `mapstructure:"data_dir"`
+		ChainID     string          `mapstructure:"chain_id"`
+		BinaryPath  string          `mapstructure:"binary_path"`
+		RPCEndpoint string          `mapstructure:"rpc_endpoint"`
+		Lifecycle   LifecycleConfig `mapstructure:"lifecycle"`
 	} `mapstructure:"node"`
 	Snapshot struct {
-		Enabled     bool          `mapstructure:"enabled"`
-		Interval    time.Duration `mapstructure:"interval"`
-		Retention   int           `mapstructure:"retention"`
-		Compression bool          `mapstructure:"compression"`
-		TempDir     string        `mapstructure:"temp_dir"`
+		Enabled             bool            `mapstructure:"enabled"`
+		Interval            time.Duration   `mapstructure:"interval"`
+		Schedule            string          `mapstructure:"schedule"`
+		Timezone            string          `mapstructure:"timezone"`
+		Jitter              time.Duration   `mapstructure:"jitter"`
+		HeightInterval      int64           `mapstructure:"height_interval"`
+		Heights             []int64         `mapstructure:"heights"`
+		HeightPollInterval  time.Duration   `mapstructure:"height_poll_interval"`
+		HealthCheck         HealthCheck     `mapstructure:"health_check"`
+		Timeout             time.Duration   `mapstructure:"timeout"`
+		Retention           int             `mapstructure:"retention"`
+		Compression         string          `mapstructure:"compression"`
+		CompressionLevel    int             `mapstructure:"compression_level"`
+		CompressionWorkers  int             `mapstructure:"compression_workers"`
+		CompressionMemoryMB int             `mapstructure:"compression_memory_mb"`
+		TempDir             string          `mapstructure:"temp_dir"`
+		Stream              bool            `mapstructure:"stream"`
+		StaleUploadAge      time.Duration   `mapstructure:"stale_upload_age"`
+		LocalRetention      RetentionPolicy `mapstructure:"local_retention"`
+		RemoteRetention     RetentionPolicy `mapstructure:"remote_retention"`
 	} `mapstructure:"snapshot"`
-	S3 struct {
-		Bucket     string `mapstructure:"bucket"`
-		Region     string `mapstructure:"region"`
-		AccessKey  string `mapstructure:"access_key"`
-		SecretKey  string `mapstructure:"secret_key"`
-		Endpoint   string `mapstructure:"endpoint"`
-		PathPrefix string `mapstructure:"path_prefix"`
-		UseSSL     bool   `mapstructure:"use_ssl"`
-	} `mapstructure:"s3"`
+	S3           S3Config            `mapstructure:"s3"`
+	Storage      StorageConfig       `mapstructure:"storage"`
+	Destinations []DestinationConfig `mapstructure:"destinations"`
 }
 
+// S3Config represents the S3 bucket snapshots are uploaded to
+type S3Config struct {
+	Bucket              string `mapstructure:"bucket"`
+	Region              string `mapstructure:"region"`
+	AccessKey           string `mapstructure:"access_key"`
+	SecretKey           string `mapstructure:"secret_key"`
+	Endpoint            string `mapstructure:"endpoint"`
+	PathPrefix          string `mapstructure:"path_prefix"`
+	UseSSL              *bool  `mapstructure:"use_ssl"`
+	ForcePathStyle      *bool  `mapstructure:"force_path_style"`
+	PartSizeMB          int    `mapstructure:"part_size_mb"`
+	UploadConcurrency   int    `mapstructure:"upload_concurrency"`
+	DownloadConcurrency int    `mapstructure:"download_concurrency"`
+}
+
+// StorageConfig selects the storage backend and holds the non-S3 backend settings
+type StorageConfig struct {
+	Type string `mapstructure:"type"`
+	Path string `mapstructure:"path"`
+	SFTP struct {
+		Host       string `mapstructure:"host"`
+		User       string `mapstructure:"user"`
+		KeyFile    string `mapstructure:"key_file"`
+		KnownHosts string `mapstructure:"known_hosts"`
+		RemoteDir  string `mapstructure:"remote_dir"`
+	} `mapstructure:"sftp"`
+}
+
+// RetentionPolicy decides which snapshots are kept. A snapshot is kept when any
+// rule selects it; max_total_size_mb then drops the oldest kept snapshots that
+// are older than min_age until the total size fits. The newest snapshot is
+// always kept.
+type RetentionPolicy struct {
+	KeepLast       int           `mapstructure:"keep_last"`
+	Hourly         int           `mapstructure:"hourly"`
+	Daily          int           `mapstructure:"daily"`
+	Weekly         int           `mapstructure:"weekly"`
+	Monthly        int           `mapstructure:"monthly"`
+	MinAge         time.Duration `mapstructure:"min_age"`
+	MaxTotalSizeMB int64         `mapstructure:"max_total_size_mb"`
+}
+
+// IsZero reports whether no retention rule is set
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+// HealthCheck decides whether a node is healthy enough to be snapshotted. A node
+// is healthy when it is not catching up and its latest block is recent; runs
+// skipped because of an unhealthy node are retried with exponential backoff.
+type HealthCheck struct {
+	Disabled         bool          `mapstructure:"disabled"`
+	MaxBlockAge      time.Duration `mapstructure:"max_block_age"`
+	RetryInterval    time.Duration `mapstructure:"retry_interval"`
+	MaxRetryInterval time.Duration `mapstructure:"max_retry_interval"`
+}
+
+// LifecycleConfig selects how a node is stopped while its data directory is
+// archived, so the archive is a consistent copy, and started again afterwards
+type LifecycleConfig struct {
+	Type          string        `mapstructure:"type"`
+	PIDFile       string        `mapstructure:"pid_file"`
+	Signal        string        `mapstructure:"signal"`
+	StopCommand   string        `mapstructure:"stop_command"`
+	StartCommand  string        `mapstructure:"start_command"`
+	StatusCommand string        `mapstructure:"status_command"`
+	StopTimeout   time.Duration `mapstructure:"stop_timeout"`
+	StartTimeout  time.Duration `mapstructure:"start_timeout"`
+	MaxDowntime   time.Duration `mapstructure:"max_downtime"`
+}
+
+// Node lifecycle controller types
+const (
+	LifecycleNone    = "none"
+	LifecyclePID     = "pid"
+	LifecycleCommand = "command"
+)
+
+// DestinationConfig is one of several places a node's snapshots are uploaded to.
+// Snapshots are kept locally until every destination that is not optional has them.
+type DestinationConfig struct {
+	Name            string          `mapstructure:"name"`
+	Optional        bool            `mapstructure:"optional"`
+	Retention       int             `mapstructure:"retention"`
+	RetentionPolicy RetentionPolicy `mapstructure:"retention_policy"`
+	PathPrefix      string          `mapstructure:"path_prefix"`
+	StorageConfig   `mapstructure:",squash"`
+	S3              S3Config `mapstructure:"s3"`
+}
+
+// Supported storage backends
+const (
+	StorageS3    = "s3"
+	StorageLocal = "local"
+	StorageSFTP  = "sftp"
+)
+
 // GlobalS3Config represents global S3 settings
 type GlobalS3Config struct {
-	AccessKey string `mapstructure:"access_key"`
-	SecretKey string `mapstructure:"secret_key"`
-	Endpoint  string `mapstructure:"endpoint"`
+	AccessKey      string `mapstructure:"access_key"`
+	SecretKey      string `mapstructure:"secret_key"`
+	Endpoint       string `mapstructure:"endpoint"`
+	UseSSL         bool   `mapstructure:"use_ssl"`
+	ForcePathStyle *bool  `mapstructure:"force_path_style"`
 }
 
 // LoggingConfig represents logging configuration
@@ -50,11 +162,24 @@ type LoggingConfig struct {
 	Format string `mapstructure:"format"`
 }
 
+// ServerConfig represents the HTTP server of the daemon
+type ServerConfig struct {
+	ListenAddress string `mapstructure:"listen_address"`
+}
+
+// DaemonConfig represents limits shared by all nodes of a daemon process
+type DaemonConfig struct {
+	MaxConcurrentArchives int `mapstructure:"max_concurrent_archives"`
+	MaxConcurrentUploads  int `mapstructure:"max_concurrent_uploads"`
+}
+
 // Config represents the application configuration
 type Config struct {
 	Nodes        map[string]NodeConfig `mapstructure:"nodes"`
 	GlobalS3     GlobalS3Config        `mapstructure:"global_s3"`
 	Logging      LoggingConfig         `mapstructure:"logging"`
+	Server       ServerConfig          `mapstructure:"server"`
+	Daemon       DaemonConfig          `mapstructure:"daemon"`
 	SelectedNode string                // Currently selected node
 }
 
@@ -103,6 +228,12 @@ func setDefaults() {
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.format", "json")
 
+	// Server defaults
+	viper.SetDefault("server.listen_address", ":8080")
+
+	// Daemon defaults
+	viper.SetDefault("daemon.max_concurrent_archives", 1)
+
 	// Node defaults
 	viper.SetDefault("nodes.cosmoshub.enabled", true)
 	viper.SetDefault("nodes.cosmoshub.node.home_dir", os.Getenv("HOME")+"/.cosmos")
@@ -113,7 +244,7 @@ func setDefaults() {
 	viper.SetDefault("nodes.cosmoshub.snapshot.enabled", true)
 	viper.SetDefault("nodes.cosmoshub.snapshot.interval", "24h")
 	viper.SetDefault("nodes.cosmoshub.snapshot.retention", 7)
-	viper.SetDefault("nodes.cosmoshub.snapshot.compression", true)
+	viper.SetDefault("nodes.cosmoshub.snapshot.compression", "gzip")
 	viper.SetDefault("nodes.cosmoshub.snapshot.temp_dir", "/tmp/snapshot-cosmos/cosmoshub")
 	viper.SetDefault("nodes.cosmoshub.s3.bucket", "q163i-snapshots")
 	viper.SetDefault("nodes.cosmoshub.s3.region", "us-east-1")
@@ -138,6 +269,14 @@ func validateConfig(cfg *Config) error {
 		return fmt.Errorf("no enabled nodes found in configuration")
 	}
 
+	if (cfg.GlobalS3.AccessKey == "") != (cfg.GlobalS3.SecretKey == "") {
+		return fmt.Errorf("global_s3: access_key and secret_key must be set together")
+	}
+
+	if cfg.Daemon.MaxConcurrentArchives < 0 || cfg.Daemon.MaxConcurrentUploads < 0 {
+		return fmt.Errorf("daemon: max_concurrent_archives and max_concurrent_uploads cannot be negative")
+	}
+
 	return nil
 }
 
@@ -152,27 +291,268 @@ func validateNodeConfig(name string, nodeCfg *NodeConfig) error {
 		return fmt.Errorf("node %s: chain_id is required", name)
 	}
 
-	// Validate S3 configuration
-	if nodeCfg.S3.Bucket == "" {
-		return fmt.Errorf("node %s: s3.bucket is required", name)
+	if err := validateLifecycle(nodeCfg.Node.Lifecycle); err != nil {
+		return fmt.Errorf("node %s: node.lifecycle: %w", name, err)
+	}
+
+	// A streamed archive keeps the node stopped until the upload finishes
+	lifecycleType := nodeCfg.Node.Lifecycle.Type
+	if nodeCfg.Snapshot.Stream && lifecycleType != "" && lifecycleType != LifecycleNone && nodeCfg.Node.Lifecycle.MaxDowntime == 0 {
+		return fmt.Errorf("node %s: snapshot.stream with node.lifecycle requires node.lifecycle.max_downtime, the node stays stopped for the whole upload", name)
+	}
+
+	// Validate storage configuration
+	if len(nodeCfg.Destinations) == 0 {
+		if err := validateStorage(nodeCfg.Storage, nodeCfg.S3); err != nil {
+			return fmt.Errorf("node %s: %w", name, err)
+		}
 	}
 
-	if nodeCfg.S3.Region == "" {
-		return fmt.Errorf("node %s: s3.region is required", name)
+	seen := map[string]bool{}
+	for i, dest := range nodeCfg.Destinations {
+		if dest.Name == "" {
+			return fmt.Errorf("node %s: destinations[%d].name is required", name, i)
+		}
+
+		if seen[dest.Name] {
+			return fmt.Errorf("node %s: duplicate destination %s", name, dest.Name)
+		}
+		seen[dest.Name] = true
+
+		if dest.Retention < 0 {
+			return fmt.Errorf("node %s: destination %s: retention cannot be negative", name, dest.Name)
+		}
+
+		if err := validateRetention(dest.RetentionPolicy); err != nil {
+			return fmt.Errorf("node %s: destination %s: retention_policy: %w", name, dest.Name, err)
+		}
+
+		if err := validateStorage(dest.StorageConfig, dest.S3); err != nil {
+			return fmt.Errorf("node %s: destination %s: %w", name, dest.Name, err)
+		}
 	}
 
 	// Validate snapshot configuration
-	if nodeCfg.Snapshot.Interval <= 0 {
-		return fmt.Errorf("node %s: snapshot.interval must be positive", name)
+	if _, err := nodeCfg.CronSchedule(); err != nil {
+		return fmt.Errorf("node %s: %w", name, err)
+	}
+
+	if nodeCfg.Snapshot.Interval < 0 {
+		return fmt.Errorf("node %s: snapshot.interval cannot be negative", name)
+	}
+
+	if nodeCfg.Snapshot.Schedule != "" && nodeCfg.Snapshot.Interval > 0 {
+		return fmt.Errorf("node %s: snapshot.interval and snapshot.schedule cannot both be set", name)
+	}
+
+	if nodeCfg.Snapshot.Schedule == "" && nodeCfg.Snapshot.Interval == 0 && !nodeCfg.HasHeightTriggers() {
+		return fmt.Errorf("node %s: snapshot.interval must be positive unless a schedule or height trigger is set", name)
+	}
+
+	if err := validateHeightTriggers(nodeCfg); err != nil {
+		return fmt.Errorf("node %s: %w", name, err)
+	}
+
+	healthCheck := nodeCfg.Snapshot.HealthCheck
+	if healthCheck.MaxBlockAge < 0 || healthCheck.RetryInterval < 0 || healthCheck.MaxRetryInterval < 0 {
+		return fmt.Errorf("node %s: snapshot.health_check durations cannot be negative", name)
+	}
+
+	if nodeCfg.Snapshot.StaleUploadAge < 0 {
+		return fmt.Errorf("node %s: snapshot.stale_upload_age cannot be negative", name)
+	}
+
+	if nodeCfg.Snapshot.Jitter < 0 {
+		return fmt.Errorf("node %s: snapshot.jitter cannot be negative", name)
+	}
+
+	if nodeCfg.Snapshot.Timeout < 0 {
+		return fmt.Errorf("node %s: snapshot.timeout cannot be negative", name)
 	}
 
 	if nodeCfg.Snapshot.Retention < 0 {
 		return fmt.Errorf("node %s: snapshot.retention cannot be negative", name)
 	}
 
+	if err := validateRetention(nodeCfg.Snapshot.LocalRetention); err != nil {
+		return fmt.Errorf("node %s: snapshot.local_retention: %w", name, err)
+	}
+
+	if err := validateRetention(nodeCfg.Snapshot.RemoteRetention); err != nil {
+		return fmt.Errorf("node %s: snapshot.remote_retention: %w", name, err)
+	}
+
+	if err := validateCompression(name, nodeCfg); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// compressionLevels maps each compression format to its valid level range
+var compressionLevels = map[string][2]int{
+	"none": {0, 0},
+	"gzip": {1, 9},
+	"zstd": {1, 22},
+	"lz4":  {1, 9},
+}
+
+// validateLifecycle validates the settings of a node lifecycle controller
+func validateLifecycle(lc LifecycleConfig) error {
+	switch lc.Type {
+	case "", LifecycleNone:
+		return nil
+	case LifecyclePID:
+		if lc.PIDFile == "" || lc.StartCommand == "" {
+			return fmt.Errorf("pid_file and start_command are required for the pid controller")
+		}
+
+		switch strings.ToUpper(lc.Signal) {
+		case "", "SIGTERM", "SIGINT", "SIGQUIT", "SIGHUP":
+		default:
+			return fmt.Errorf("unsupported signal %q", lc.Signal)
+		}
+	case LifecycleCommand:
+		if lc.StopCommand == "" || lc.StartCommand == "" || lc.StatusCommand == "" {
+			return fmt.Errorf("stop_command, start_command and status_command are required for the command controller")
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", lc.Type)
+	}
+
+	if lc.StopTimeout < 0 || lc.StartTimeout < 0 || lc.MaxDowntime < 0 {
+		return fmt.Errorf("durations cannot be negative")
+	}
+
+	return nil
+}
+
+// validateStorage validates the settings of a storage backend
+func validateStorage(storage StorageConfig, s3Cfg S3Config) error {
+	switch storage.Type {
+	case "", StorageS3:
+		if s3Cfg.Bucket == "" {
+			return fmt.Errorf("s3.bucket is required")
+		}
+
+		if s3Cfg.Region == "" {
+			return fmt.Errorf("s3.region is required")
+		}
+	case StorageLocal:
+		if storage.Path == "" {
+			return fmt.Errorf("path is required for local storage")
+		}
+	case StorageSFTP:
+		if storage.SFTP.Host == "" || storage.SFTP.User == "" {
+			return fmt.Errorf("sftp.host and sftp.user are required for sftp storage")
+		}
+
+		if storage.SFTP.KeyFile == "" {
+			return fmt.Errorf("sftp.key_file is required for sftp storage")
+		}
+	default:
+		return fmt.Errorf("unsupported storage type %q", storage.Type)
+	}
+
+	// Validate S3 configuration
+	if (s3Cfg.AccessKey == "") != (s3Cfg.SecretKey == "") {
+		return fmt.Errorf("s3.access_key and s3.secret_key must be set together")
+	}
+
+	// S3 allows parts between 5 MiB and 5 GiB
+	if s3Cfg.PartSizeMB != 0 && (s3Cfg.PartSizeMB < 5 || s3Cfg.PartSizeMB > 5120) {
+		return fmt.Errorf("s3.part_size_mb must be between 5 and 5120")
+	}
+
+	if s3Cfg.UploadConcurrency < 0 {
+		return fmt.Errorf("s3.upload_concurrency cannot be negative")
+	}
+
+	if s3Cfg.DownloadConcurrency < 0 {
+		return fmt.Errorf("s3.download_concurrency cannot be negative")
+	}
+
+	return nil
+}
+
+// validateHeightTriggers validates the block height snapshot triggers of a node
+func validateHeightTriggers(nodeCfg *NodeConfig) error {
+	if nodeCfg.Snapshot.HeightInterval < 0 {
+		return fmt.Errorf("snapshot.height_interval cannot be negative")
+	}
+
+	for _, height := range nodeCfg.Snapshot.Heights {
+		if height <= 0 {
+			return fmt.Errorf("snapshot.heights must be positive")
+		}
+	}
+
+	if nodeCfg.Snapshot.HeightPollInterval < 0 {
+		return fmt.Errorf("snapshot.height_poll_interval cannot be negative")
+	}
+
+	if nodeCfg.HasHeightTriggers() && nodeCfg.Node.RPCEndpoint == "" {
+		return fmt.Errorf("node.rpc_endpoint is required for height triggers")
+	}
+
+	return nil
+}
+
+// validateRetention validates a retention policy
+func validateRetention(policy RetentionPolicy) error {
+	if policy.KeepLast < 0 || policy.Hourly < 0 || policy.Daily < 0 || policy.Weekly < 0 || policy.Monthly < 0 {
+		return fmt.Errorf("snapshot counts cannot be negative")
+	}
+
+	if policy.MinAge < 0 {
+		return fmt.Errorf("min_age cannot be negative")
+	}
+
+	if policy.MaxTotalSizeMB < 0 {
+		return fmt.Errorf("max_total_size_mb cannot be negative")
+	}
+
+	return nil
+}
+
+// validateCompression validates the snapshot compression settings of a node
+func validateCompression(name string, nodeCfg *NodeConfig) error {
+	format := normalizeCompression(nodeCfg.Snapshot.Compression)
+
+	levels, ok := compressionLevels[format]
+	if !ok {
+		return fmt.Errorf("node %s: snapshot.compression must be one of none, gzip, zstd, lz4", name)
+	}
+
+	if nodeCfg.Snapshot.CompressionWorkers < 0 {
+		return fmt.Errorf("node %s: snapshot.compression_workers cannot be negative", name)
+	}
+
+	if nodeCfg.Snapshot.CompressionMemoryMB < 0 {
+		return fmt.Errorf("node %s: snapshot.compression_memory_mb cannot be negative", name)
+	}
+
+	level := nodeCfg.Snapshot.CompressionLevel
+	if level != 0 && (level < levels[0] || level > levels[1]) {
+		return fmt.Errorf("node %s: snapshot.compression_level for %s must be between %d and %d", name, format, levels[0], levels[1])
+	}
+
+	return nil
+}
+
+// normalizeCompression maps the legacy boolean compression setting and the
+// empty value onto a compression format name
+func normalizeCompression(compression string) string {
+	switch compression {
+	case "", "true", "1":
+		return "gzip"
+	case "false", "0":
+		return "none"
+	default:
+		return compression
+	}
+}
+
 // GetEnabledNodes returns a list of enabled nodes
 func (c *Config) GetEnabledNodes() []string {
 	var enabled []string
@@ -195,20 +575,145 @@ func (c *Config) GetNodeConfig(nodeName string) (*NodeConfig, error) {
 		return nil, fmt.Errorf("node %s is not enabled", nodeName)
 	}
 
+	nodeCfg.Name = nodeName
+
 	// Merge with global S3 settings if not set
-	if nodeCfg.S3.AccessKey == "" {
-		nodeCfg.S3.AccessKey = c.GlobalS3.AccessKey
+	c.mergeGlobalS3(&nodeCfg.S3)
+
+	if nodeCfg.Storage.Type == "" {
+		nodeCfg.Storage.Type = StorageS3
 	}
-	if nodeCfg.S3.SecretKey == "" {
-		nodeCfg.S3.SecretKey = c.GlobalS3.SecretKey
+
+	// A plain retention count keeps the last snapshots locally and remotely
+	if nodeCfg.Snapshot.LocalRetention.IsZero() {
+		nodeCfg.Snapshot.LocalRetention = RetentionPolicy{KeepLast: nodeCfg.Snapshot.Retention}
 	}
-	if nodeCfg.S3.Endpoint == "" {
-		nodeCfg.S3.Endpoint = c.GlobalS3.Endpoint
+	if nodeCfg.Snapshot.RemoteRetention.IsZero() {
+		nodeCfg.Snapshot.RemoteRetention = RetentionPolicy{KeepLast: nodeCfg.Snapshot.Retention}
 	}
 
+	// Destinations get their own copy so the map entry is left untouched
+	destinations := make([]DestinationConfig, len(nodeCfg.Destinations))
+	for i, dest := range nodeCfg.Destinations {
+		c.mergeGlobalS3(&dest.S3)
+		if dest.Type == "" {
+			dest.Type = StorageS3
+		}
+		if dest.PathPrefix == "" {
+			dest.PathPrefix = dest.S3.PathPrefix
+		}
+		if dest.PathPrefix == "" {
+			dest.PathPrefix = nodeCfg.S3.PathPrefix
+		}
+		if dest.RetentionPolicy.IsZero() {
+			if dest.Retention > 0 {
+				dest.RetentionPolicy = RetentionPolicy{KeepLast: dest.Retention}
+			} else {
+				dest.RetentionPolicy = nodeCfg.Snapshot.RemoteRetention
+			}
+		}
+		destinations[i] = dest
+	}
+	nodeCfg.Destinations = destinations
+
+	nodeCfg.Snapshot.Compression = normalizeCompression(nodeCfg.Snapshot.Compression)
+
 	return &nodeCfg, nil
 }
 
+// mergeGlobalS3 fills S3 settings that are not set from the global S3 settings
+func (c *Config) mergeGlobalS3(s3Cfg *S3Config) {
+	if s3Cfg.AccessKey == "" && s3Cfg.SecretKey == "" {
+		s3Cfg.AccessKey = c.GlobalS3.AccessKey
+		s3Cfg.SecretKey = c.GlobalS3.SecretKey
+	}
+	if s3Cfg.Endpoint == "" {
+		s3Cfg.Endpoint = c.GlobalS3.Endpoint
+	}
+	if s3Cfg.UseSSL == nil {
+		useSSL := c.GlobalS3.UseSSL
+		s3Cfg.UseSSL = &useSSL
+	}
+	if s3Cfg.ForcePathStyle == nil {
+		s3Cfg.ForcePathStyle = c.GlobalS3.ForcePathStyle
+	}
+}
+
+// GetDestinations returns the upload destinations of the node. Without explicit
+// destinations the node's own storage settings form a single required destination.
+func (nc *NodeConfig) GetDestinations() []DestinationConfig {
+	if len(nc.Destinations) > 0 {
+		return nc.Destinations
+	}
+
+	storageType := nc.Storage.Type
+	if storageType == "" {
+		storageType = StorageS3
+	}
+
+	return []DestinationConfig{{
+		Name:            storageType,
+		Retention:       nc.Snapshot.Retention,
+		RetentionPolicy: nc.Snapshot.RemoteRetention,
+		PathPrefix:      nc.S3.PathPrefix,
+		StorageConfig:   nc.Storage,
+		S3:              nc.S3,
+	}}
+}
+
+// GetDestination returns the destination called name, or the first required
+// destination when name is empty
+func (nc *NodeConfig) GetDestination(name string) (DestinationConfig, error) {
+	destinations := nc.GetDestinations()
+
+	if name == "" {
+		for _, dest := range destinations {
+			if !dest.Optional {
+				return dest, nil
+			}
+		}
+		return destinations[0], nil
+	}
+
+	names := make([]string, 0, len(destinations))
+	for _, dest := range destinations {
+		if dest.Name == name {
+			return dest, nil
+		}
+		names = append(names, dest.Name)
+	}
+
+	return DestinationConfig{}, fmt.Errorf("unknown destination %s, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// CronSchedule parses the snapshot schedule in the configured timezone. It
+// returns nil when snapshots run on the plain interval.
+func (nc *NodeConfig) CronSchedule() (cron.Schedule, error) {
+	if nc.Snapshot.Schedule == "" {
+		return nil, nil
+	}
+
+	spec := nc.Snapshot.Schedule
+	if nc.Snapshot.Timezone != "" {
+		if _, err := time.LoadLocation(nc.Snapshot.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid snapshot.timezone: %w", err)
+		}
+		spec = fmt.Sprintf("CRON_TZ=%s %s", nc.Snapshot.Timezone, spec)
+	}
+
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot.schedule: %w", err)
+	}
+
+	return schedule, nil
+}
+
+// HasHeightTriggers reports whether snapshots are triggered by block height
+func (nc *NodeConfig) HasHeightTriggers() bool {
+	return nc.Snapshot.HeightInterval > 0 || len(nc.Snapshot.Heights) > 0
+}
+
 // GetNodeDataPath returns the full path to the node data directory
 func (nc *NodeConfig) GetNodeDataPath() string {
 	return filepath.Join(nc.Node.HomeDir, nc.Node.DataDir)
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/q163i/snapshot-cosmos/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// api serves the HTTP control API of the daemon services
+type api struct {
+	services map[string]*Service
+	order    []*Service
+	logger   *zap.Logger
+}
+
+// NewHandler returns the HTTP API of the daemon services: health and readiness
+// probes, metrics, run status and on-demand snapshots
+func NewHandler(services []*Service, logger *zap.Logger) http.Handler {
+	a := &api{
+		services: make(map[string]*Service, len(services)),
+		order:    services,
+		logger:   logger,
+	}
+	for _, svc := range services {
+		a.services[svc.cfg.Name] = svc
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", a.healthz)
+	mux.HandleFunc("GET /readyz", a.readyz)
+	mux.HandleFunc("GET /status", a.status)
+	mux.HandleFunc("POST /nodes/{name}/snapshot", a.snapshot)
+	mux.Handle("GET /metrics", metrics.Handler())
+	return mux
+}
+
+// healthz reports that the process is serving requests
+func (a *api) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether every service has started its snapshot loop
+func (a *api) readyz(w http.ResponseWriter, r *http.Request) {
+	for _, svc := range a.order {
+		if !svc.Ready() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+				"status": "not ready",
+				"node":   svc.cfg.Name,
+			})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// status returns the state of every node's snapshot runs
+func (a *api) status(w http.ResponseWriter, r *http.Request) {
+	nodes := make([]Status, 0, len(a.order))
+	for _, svc := range a.order {
+		nodes = append(nodes, svc.Status())
+	}
+	writeJSON(w, http.StatusOK, map[string][]Status{"nodes": nodes})
+}
+
+// snapshot starts an immediate snapshot run of a node
+func (a *api) snapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	svc, ok := a.services[name]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown node " + name})
+		return
+	}
+
+	if err := svc.Trigger(); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	a.logger.Info("Snapshot requested over HTTP",
+		zap.String("node", name),
+		zap.String("remote_addr", r.RemoteAddr))
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "snapshot queued", "node": name})
+}
+
+// writeJSON writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,163 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"go.uber.org/zap"
+)
+
+// newTestAPI serves the API of two nodes, a and b
+func newTestAPI(t *testing.T) (*httptest.Server, *Service, *Service) {
+	t.Helper()
+
+	var services []*Service
+	for _, name := range []string{"a", "b"} {
+		cfg := &config.NodeConfig{Name: name}
+		cfg.Node.ChainID = "test-1"
+		services = append(services, NewService(cfg, zap.NewNop()))
+	}
+
+	server := httptest.NewServer(NewHandler(services, zap.NewNop()))
+	t.Cleanup(server.Close)
+
+	return server, services[0], services[1]
+}
+
+// request sends a request to the API and decodes the JSON response into v
+func request(t *testing.T, method, url string, v any) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type = %s", method, url, ct)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHealthz(t *testing.T) {
+	server, _, _ := newTestAPI(t)
+
+	var body map[string]string
+	if code := request(t, http.MethodGet, server.URL+"/healthz", &body); code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("GET /healthz = %d %v", code, body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	server, a, b := newTestAPI(t)
+
+	var body map[string]string
+	if code := request(t, http.MethodGet, server.URL+"/readyz", &body); code != http.StatusServiceUnavailable || body["node"] != "a" {
+		t.Errorf("GET /readyz before start = %d %v, want 503 for a", code, body)
+	}
+
+	// Every node has to be ready
+	a.setReady(true)
+	if code := request(t, http.MethodGet, server.URL+"/readyz", &body); code != http.StatusServiceUnavailable || body["node"] != "b" {
+		t.Errorf("GET /readyz with b starting = %d %v, want 503 for b", code, body)
+	}
+
+	b.setReady(true)
+	body = nil
+	if code := request(t, http.MethodGet, server.URL+"/readyz", &body); code != http.StatusOK || body["status"] != "ready" {
+		t.Errorf("GET /readyz = %d %v, want 200", code, body)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	server, a, b := newTestAPI(t)
+
+	nextRun := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	a.setReady(true)
+	a.setNextRun(nextRun)
+	a.setHeights(120, 150)
+	a.startRun()
+	a.finishRun(errors.New("upload failed"))
+	b.startRun()
+	b.setPhase("upload")
+	b.startUploads(3)
+	b.uploadDone()
+
+	var body struct {
+		Nodes []Status `json:"nodes"`
+	}
+	if code := request(t, http.MethodGet, server.URL+"/status", &body); code != http.StatusOK {
+		t.Fatalf("GET /status = %d", code)
+	}
+	if len(body.Nodes) != 2 || body.Nodes[0].Node != "a" || body.Nodes[1].Node != "b" {
+		t.Fatalf("nodes = %+v, want a and b in order", body.Nodes)
+	}
+
+	got := body.Nodes[0]
+	if !got.Ready || got.ChainID != "test-1" || got.Height != 120 || got.NextHeight != 150 {
+		t.Errorf("status of a = %+v", got)
+	}
+	if got.NextRun == nil || !got.NextRun.Equal(nextRun) {
+		t.Errorf("next run of a = %v, want %s", got.NextRun, nextRun)
+	}
+	if got.LastRun == nil || got.LastRun.Success || got.LastRun.Result != RunFailed || got.LastRun.Error != "upload failed" {
+		t.Errorf("last run of a = %+v", got.LastRun)
+	}
+
+	got = body.Nodes[1]
+	if got.Phase != "upload" || got.Upload == nil || *got.Upload != (UploadProgress{Done: 1, Total: 3}) {
+		t.Errorf("status of b = %+v, upload %+v", got, got.Upload)
+	}
+}
+
+func TestSnapshotRequest(t *testing.T) {
+	server, a, b := newTestAPI(t)
+
+	var body map[string]string
+	if code := request(t, http.MethodPost, server.URL+"/nodes/a/snapshot", &body); code != http.StatusAccepted || body["node"] != "a" {
+		t.Errorf("POST /nodes/a/snapshot = %d %v, want 202", code, body)
+	}
+	select {
+	case <-a.trigger:
+	default:
+		t.Fatal("accepted request did not queue a run")
+	}
+
+	// A queued request is not queued twice
+	a.trigger <- struct{}{}
+	if code := request(t, http.MethodPost, server.URL+"/nodes/a/snapshot", &body); code != http.StatusConflict || body["error"] != ErrSnapshotRunning.Error() {
+		t.Errorf("POST with a queued run = %d %v, want 409", code, body)
+	}
+
+	// Nor is one while a run is in progress
+	b.startRun()
+	if code := request(t, http.MethodPost, server.URL+"/nodes/b/snapshot", &body); code != http.StatusConflict {
+		t.Errorf("POST with a running run = %d %v, want 409", code, body)
+	}
+	if len(b.trigger) != 0 {
+		t.Error("request queued a run while one was in progress")
+	}
+
+	if code := request(t, http.MethodPost, server.URL+"/nodes/missing/snapshot", &body); code != http.StatusNotFound {
+		t.Errorf("POST /nodes/missing/snapshot = %d %v, want 404", code, body)
+	}
+
+	if code := request(t, http.MethodGet, server.URL+"/nodes/a/snapshot", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /nodes/a/snapshot = %d, want 405", code)
+	}
+}
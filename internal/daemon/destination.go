@@ -0,0 +1,386 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/metrics"
+	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"github.com/q163i/snapshot-cosmos/internal/storage/backend"
+	"go.uber.org/zap"
+)
+
+// discardTimeout bounds deleting the archive of a failed stream from a destination
+const discardTimeout = time.Minute
+
+// defaultStaleUploadAge is how old an unfinished upload must be before it is
+// aborted at startup, so uploads of other processes sharing storage survive
+const defaultStaleUploadAge = 24 * time.Hour
+
+// destination is a storage backend snapshots are uploaded to
+type destination struct {
+	config.DestinationConfig
+	store storage.Backend
+}
+
+// key returns the storage key of an archive at the destination
+func (d *destination) key(name string) string {
+	return fmt.Sprintf("%s/%s", d.PathPrefix, name)
+}
+
+// uploadResult is the outcome of uploading a snapshot to one destination
+type uploadResult struct {
+	dest     *destination
+	key      string
+	duration time.Duration
+	err      error
+}
+
+// pendingUpload lists the required destinations a local archive still has to reach
+type pendingUpload struct {
+	Destinations []string `json:"destinations"`
+}
+
+// openDestinations creates the storage backend of every configured destination
+func (s *Service) openDestinations() error {
+	s.destinations = nil
+	for _, destCfg := range s.cfg.GetDestinations() {
+		store, err := backend.NewDestination(s.cfg, destCfg, s.logger)
+		if err != nil {
+			return fmt.Errorf("failed to open destination %s: %w", destCfg.Name, err)
+		}
+		s.destinations = append(s.destinations, &destination{DestinationConfig: destCfg, store: store})
+	}
+	return nil
+}
+
+// uploadToAll uploads a local archive and its sidecars to the destinations concurrently
+func (s *Service) uploadToAll(ctx context.Context, snapshotPath string, dests []*destination) []uploadResult {
+	results := make([]uploadResult, len(dests))
+	s.startUploads(len(dests))
+
+	var wg sync.WaitGroup
+	for i, dest := range dests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.uploadDone()
+			key := dest.key(filepath.Base(snapshotPath))
+
+			// Wait until uploading does not exceed the process limit
+			if err := s.limits.uploads.acquire(ctx); err != nil {
+				results[i] = uploadResult{dest: dest, key: key, err: fmt.Errorf("failed to wait for an upload slot: %w", err)}
+				return
+			}
+			defer s.limits.uploads.release()
+
+			start := time.Now()
+			err := dest.store.Upload(ctx, snapshotPath, key)
+			results[i] = uploadResult{dest: dest, key: key, duration: time.Since(start), err: err}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// uploadSidecarsToAll uploads the sidecars of a streamed archive to every
+// destination that received the archive, recording failures in results
+func (s *Service) uploadSidecarsToAll(ctx context.Context, snapshotPath string, results []uploadResult) {
+	var wg sync.WaitGroup
+	for i := range results {
+		if results[i].err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(result *uploadResult) {
+			defer wg.Done()
+			if err := result.dest.store.UploadSidecars(ctx, snapshotPath, result.key); err != nil {
+				result.err = fmt.Errorf("failed to upload snapshot sidecars: %w", err)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+}
+
+// reportUploads logs and records the outcome of an upload for every destination
+func (s *Service) reportUploads(results []uploadResult) {
+	for _, result := range results {
+		if result.err != nil {
+			s.metrics.Error(metrics.PhaseUpload)
+			s.logger.Error("Failed to upload snapshot to destination",
+				zap.String("destination", result.dest.Name),
+				zap.Bool("optional", result.dest.Optional),
+				zap.String("key", result.key),
+				zap.Error(result.err))
+			continue
+		}
+
+		s.metrics.ObservePhase(metrics.PhaseUpload, result.duration)
+		s.logger.Info("Uploaded snapshot to destination",
+			zap.String("destination", result.dest.Name),
+			zap.String("key", result.key),
+			zap.Duration("duration", result.duration))
+	}
+}
+
+// failedRequired returns the names of required destinations whose upload failed
+func failedRequired(results []uploadResult) []string {
+	var failed []string
+	for _, result := range results {
+		if result.err != nil && !result.dest.Optional {
+			failed = append(failed, result.dest.Name)
+		}
+	}
+	return failed
+}
+
+// storedAnywhere reports whether at least one destination received the archive
+func storedAnywhere(results []uploadResult) bool {
+	for _, result := range results {
+		if result.err == nil {
+			return true
+		}
+	}
+	return len(results) == 0
+}
+
+// retryPendingUploads uploads local archives marked pending to the required
+// destinations they are still missing from
+func (s *Service) retryPendingUploads(ctx context.Context) {
+	markers, err := filepath.Glob(filepath.Join(s.cfg.GetSnapshotPath(), "*"+snapshot.PendingSuffix))
+	if err != nil {
+		return
+	}
+
+	for _, marker := range markers {
+		snapshotPath := strings.TrimSuffix(marker, snapshot.PendingSuffix)
+
+		pending, err := readPending(marker)
+		if err != nil {
+			s.logger.Warn("Ignoring unreadable pending marker", zap.String("file", marker), zap.Error(err))
+			continue
+		}
+
+		if _, err := os.Stat(snapshotPath); os.IsNotExist(err) {
+			os.Remove(marker)
+			continue
+		}
+
+		// Only retry destinations that are still configured
+		var dests []*destination
+		for _, dest := range s.destinations {
+			for _, name := range pending.Destinations {
+				if dest.Name == name {
+					dests = append(dests, dest)
+				}
+			}
+		}
+
+		s.setPhase(metrics.PhaseUpload)
+		s.logger.Info("Retrying pending snapshot upload",
+			zap.String("snapshot_path", snapshotPath),
+			zap.Strings("destinations", pending.Destinations))
+
+		results := s.uploadToAll(ctx, snapshotPath, dests)
+		s.reportUploads(results)
+
+		if failed := failedRequired(results); len(failed) > 0 {
+			if err := writePending(snapshotPath, failed); err != nil {
+				s.logger.Error("Failed to update pending marker", zap.Error(err))
+			}
+			continue
+		}
+
+		if err := os.Remove(marker); err != nil {
+			s.logger.Warn("Failed to remove pending marker", zap.String("file", marker), zap.Error(err))
+		}
+	}
+}
+
+// readPending reads the pending marker of an archive
+func readPending(markerPath string) (*pendingUpload, error) {
+	data, err := os.ReadFile(markerPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending marker: %w", err)
+	}
+
+	var pending pendingUpload
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, fmt.Errorf("failed to decode pending marker: %w", err)
+	}
+
+	return &pending, nil
+}
+
+// writePending marks an archive as still missing from the named destinations
+func writePending(snapshotPath string, destinations []string) error {
+	data, err := json.Marshal(pendingUpload{Destinations: destinations})
+	if err != nil {
+		return fmt.Errorf("failed to encode pending marker: %w", err)
+	}
+
+	if err := os.WriteFile(snapshotPath+snapshot.PendingSuffix, data, 0644); err != nil {
+		return fmt.Errorf("failed to write pending marker: %w", err)
+	}
+
+	return nil
+}
+
+// fanoutWriter streams an archive to several destinations at once. A failing
+// optional destination is dropped, a failing required destination fails the
+// stream and no destination keeps the archive.
+type fanoutWriter struct {
+	ctx     context.Context
+	targets []*fanoutTarget
+	written int64
+	logger  *zap.Logger
+}
+
+// fanoutTarget is the stream to a single destination
+type fanoutTarget struct {
+	dest    *destination
+	key     string
+	w       storage.Writer
+	started time.Time
+	closed  bool
+	err     error
+}
+
+// newFanoutWriter opens a stream to every destination
+func (s *Service) newFanoutWriter(ctx context.Context, name, contentType string) (*fanoutWriter, error) {
+	f := &fanoutWriter{ctx: ctx, logger: s.logger}
+	for _, dest := range s.destinations {
+		target := &fanoutTarget{dest: dest, key: dest.key(name), started: time.Now()}
+		f.targets = append(f.targets, target)
+
+		target.w, target.err = dest.store.NewWriter(ctx, target.key, contentType)
+		if target.err != nil && !dest.Optional {
+			return nil, f.CloseWithError(fmt.Errorf("destination %s: %w", dest.Name, target.err))
+		}
+	}
+	return f, nil
+}
+
+// Write writes p to every destination that has not failed yet
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	for _, target := range f.targets {
+		if target.err != nil {
+			continue
+		}
+		if _, err := target.w.Write(p); err != nil {
+			target.closed = true
+			target.err = err
+			target.w.CloseWithError(err)
+			if !target.dest.Optional {
+				return 0, fmt.Errorf("destination %s: %w", target.dest.Name, err)
+			}
+		}
+	}
+	if f.failed() {
+		return 0, fmt.Errorf("every destination failed: %w", f.targetErrors())
+	}
+	f.written += int64(len(p))
+	return len(p), nil
+}
+
+// Close finishes the stream to the required destinations first, so a failure
+// among them can still abort the optional ones
+func (f *fanoutWriter) Close() error {
+	var errs []error
+	for _, target := range f.targets {
+		if target.err != nil || target.dest.Optional {
+			continue
+		}
+		target.closed = true
+		if target.err = target.w.Close(); target.err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", target.dest.Name, target.err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return f.CloseWithError(err)
+	}
+
+	for _, target := range f.targets {
+		if target.err == nil && !target.closed {
+			target.closed = true
+			target.err = target.w.Close()
+		}
+	}
+	if f.failed() {
+		return fmt.Errorf("every destination failed: %w", f.targetErrors())
+	}
+	return nil
+}
+
+// failed reports whether no destination is left to receive the archive
+func (f *fanoutWriter) failed() bool {
+	for _, target := range f.targets {
+		if target.err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// targetErrors joins the errors of the failed destinations
+func (f *fanoutWriter) targetErrors() error {
+	var errs []error
+	for _, target := range f.targets {
+		if target.err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", target.dest.Name, target.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CloseWithError aborts the stream to every destination, deletes the archive
+// from destinations that already finished it and returns err
+func (f *fanoutWriter) CloseWithError(err error) error {
+	for _, target := range f.targets {
+		switch {
+		case target.err != nil:
+		case !target.closed:
+			target.closed = true
+			target.err = err
+			target.w.CloseWithError(err)
+		default:
+			// The archive of a failed run would never get its sidecars, remove
+			// it even when the run was cancelled
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(f.ctx), discardTimeout)
+			deleteErr := target.dest.store.Delete(ctx, target.key)
+			cancel()
+			if deleteErr != nil {
+				f.logger.Warn("Failed to delete archive of failed stream",
+					zap.String("destination", target.dest.Name),
+					zap.String("key", target.key),
+					zap.Error(deleteErr))
+			}
+			target.err = fmt.Errorf("discarded: %w", err)
+		}
+	}
+	return err
+}
+
+// results returns the outcome of the stream for every destination
+func (f *fanoutWriter) results() []uploadResult {
+	results := make([]uploadResult, len(f.targets))
+	for i, target := range f.targets {
+		results[i] = uploadResult{
+			dest:     target.dest,
+			key:      target.key,
+			duration: time.Since(target.started),
+			err:      target.err,
+		}
+	}
+	return results
+}
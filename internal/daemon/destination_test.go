@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"go.uber.org/zap"
+)
+
+// memoryStore is a storage backend keeping streamed objects in memory
+type memoryStore struct {
+	storage.Backend
+	objects  map[string][]byte
+	writeErr error
+	closeErr error
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string][]byte{}}
+}
+
+func (m *memoryStore) NewWriter(ctx context.Context, key, contentType string) (storage.Writer, error) {
+	return &memoryWriter{store: m, key: key}, nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, key string) error {
+	delete(m.objects, key)
+	return nil
+}
+
+// memoryWriter stores its object on Close
+type memoryWriter struct {
+	store *memoryStore
+	key   string
+	buf   bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.store.writeErr != nil {
+		return 0, w.store.writeErr
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	if w.store.closeErr != nil {
+		return w.store.closeErr
+	}
+	w.store.objects[w.key] = w.buf.Bytes()
+	return nil
+}
+
+func (w *memoryWriter) CloseWithError(err error) error {
+	return nil
+}
+
+func TestFanoutWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		requiredErr error
+		optionalErr error
+		// writeErr fails writes to the optional destination
+		writeErr error
+		// bothRequired makes the first destination required as well
+		bothRequired bool
+		// bothOptional makes the second destination optional as well
+		bothOptional bool
+		wantErr      bool
+		wantStored   [2]bool
+	}{
+		{name: "all succeed", wantStored: [2]bool{true, true}},
+		{name: "optional fails", optionalErr: errors.New("boom"), wantStored: [2]bool{true, false}},
+		{name: "required fails", requiredErr: errors.New("boom"), wantErr: true},
+		{name: "finished copy deleted", requiredErr: errors.New("boom"), bothRequired: true, wantErr: true},
+		{name: "optional write fails", writeErr: errors.New("boom"), wantStored: [2]bool{true, false}},
+		{name: "one of all optional fails", optionalErr: errors.New("boom"), bothOptional: true, wantStored: [2]bool{true, false}},
+		{name: "all optional fail", requiredErr: errors.New("boom"), optionalErr: errors.New("boom"), bothOptional: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			required, optional := newMemoryStore(), newMemoryStore()
+			required.closeErr, optional.closeErr = tt.requiredErr, tt.optionalErr
+			optional.writeErr = tt.writeErr
+
+			// The optional destination comes first, so it would finish first
+			s := &Service{logger: zap.NewNop(), destinations: []*destination{
+				{DestinationConfig: config.DestinationConfig{Name: "optional", Optional: !tt.bothRequired, PathPrefix: "p"}, store: optional},
+				{DestinationConfig: config.DestinationConfig{Name: "required", Optional: tt.bothOptional, PathPrefix: "p"}, store: required},
+			}}
+
+			f, err := s.newFanoutWriter(context.Background(), "a.tar", "application/x-tar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(f, "archive"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := f.Close(); (err != nil) != tt.wantErr {
+				t.Fatalf("Close() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			stored := [2]bool{len(required.objects) == 1, len(optional.objects) == 1}
+			if stored != tt.wantStored {
+				t.Fatalf("stored (required, optional) = %v, want %v", stored, tt.wantStored)
+			}
+
+			results := f.results()
+			if got := storedAnywhere(results); got != (stored != [2]bool{}) {
+				t.Errorf("storedAnywhere() = %v with stored %v", got, stored)
+			}
+			for _, result := range results {
+				if stored := len(result.dest.store.(*memoryStore).objects) == 1; stored != (result.err == nil) {
+					t.Errorf("destination %s: stored = %v, err = %v", result.dest.Name, stored, result.err)
+				}
+			}
+		})
+	}
+}
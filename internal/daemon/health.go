@@ -0,0 +1,105 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/lifecycle"
+	"github.com/q163i/snapshot-cosmos/internal/rpc"
+)
+
+// Health check defaults
+const (
+	defaultMaxBlockAge      = 5 * time.Minute
+	defaultRetryInterval    = time.Minute
+	defaultMaxRetryInterval = 30 * time.Minute
+)
+
+// ErrNodeUnhealthy is returned for runs skipped because the node is syncing,
+// halted or unreachable
+var ErrNodeUnhealthy = errors.New("node is unhealthy")
+
+// checkHealth queries the node status and fails with ErrNodeUnhealthy when the
+// node is catching up or its latest block is older than the allowed age. Nodes
+// without an RPC endpoint are not checked.
+func (s *Service) checkHealth(ctx context.Context) error {
+	healthCheck := s.cfg.Snapshot.HealthCheck
+	if healthCheck.Disabled || s.cfg.Node.RPCEndpoint == "" {
+		return nil
+	}
+
+	maxBlockAge := healthCheck.MaxBlockAge
+	if maxBlockAge == 0 {
+		maxBlockAge = defaultMaxBlockAge
+	}
+
+	status, err := rpc.NewClient(s.cfg.Node.RPCEndpoint, heightRPCTimeout).Status(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if s.stoppedOnPurpose(ctx) {
+			s.logger.Info("Node is stopped, archiving it without a health check")
+			return nil
+		}
+		return fmt.Errorf("%w: %w", ErrNodeUnhealthy, err)
+	}
+
+	if status.SyncInfo.CatchingUp {
+		return fmt.Errorf("%w: catching up at height %d", ErrNodeUnhealthy, status.SyncInfo.LatestBlockHeight)
+	}
+
+	if age := time.Since(status.SyncInfo.LatestBlockTime); age > maxBlockAge {
+		return fmt.Errorf("%w: latest block %d is %s old, at most %s allowed",
+			ErrNodeUnhealthy, status.SyncInfo.LatestBlockHeight, age.Round(time.Second), maxBlockAge)
+	}
+
+	return nil
+}
+
+// stoppedOnPurpose reports whether a lifecycle controller sees the node stopped.
+// Such a node is archived as it is rather than waited for.
+func (s *Service) stoppedOnPurpose(ctx context.Context) bool {
+	controller, err := lifecycle.New(s.cfg, s.logger)
+	if err != nil || controller == nil {
+		return false
+	}
+
+	running, err := controller.Running(ctx)
+	return err == nil && !running
+}
+
+// backoff spaces out the retries of runs skipped because the node was unhealthy
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// newBackoff creates the retry backoff from the node's health check settings
+func newBackoff(initial, max time.Duration) *backoff {
+	if initial == 0 {
+		initial = defaultRetryInterval
+	}
+	if max == 0 {
+		max = defaultMaxRetryInterval
+	}
+	return &backoff{initial: initial, max: max}
+}
+
+// next returns the delay before the next retry, doubling it each time up to max
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.initial
+	} else {
+		b.current = min(b.current*2, b.max)
+	}
+	return b.current
+}
+
+// reset starts the next series of retries at the initial delay
+func (b *backoff) reset() {
+	b.current = 0
+}
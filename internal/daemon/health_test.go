@@ -0,0 +1,242 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"go.uber.org/zap"
+)
+
+// statusServer is a CometBFT RPC endpoint serving a configurable /status
+type statusServer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	height     int64
+	catchingUp bool
+	blockTime  time.Time
+	down       bool
+}
+
+func newStatusServer(t *testing.T, height int64) *statusServer {
+	t.Helper()
+
+	s := &statusServer{height: height, blockTime: time.Now()}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"result": map[string]any{
+			"node_info": map[string]any{"network": "test-1"},
+			"sync_info": map[string]any{
+				"latest_block_height": strconv.FormatInt(s.height, 10),
+				"latest_block_time":   s.blockTime,
+				"catching_up":         s.catchingUp,
+			},
+		}})
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// set changes the status under the server's lock
+func (s *statusServer) set(fn func(s *statusServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s)
+}
+
+func TestCheckHealth(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    func(s *statusServer)
+		lifecycle config.LifecycleConfig
+		healthy   bool
+	}{
+		{
+			name:    "in sync",
+			status:  func(s *statusServer) {},
+			healthy: true,
+		},
+		{
+			name:   "catching up",
+			status: func(s *statusServer) { s.catchingUp = true },
+		},
+		{
+			name:   "halted chain",
+			status: func(s *statusServer) { s.blockTime = time.Now().Add(-time.Hour) },
+		},
+		{
+			name:   "unreachable",
+			status: func(s *statusServer) { s.down = true },
+		},
+		{
+			name:   "unreachable while the controller sees it running",
+			status: func(s *statusServer) { s.down = true },
+			lifecycle: config.LifecycleConfig{
+				Type:          config.LifecycleCommand,
+				StopCommand:   "true",
+				StartCommand:  "true",
+				StatusCommand: "true",
+			},
+		},
+		{
+			name:   "stopped on purpose",
+			status: func(s *statusServer) { s.down = true },
+			lifecycle: config.LifecycleConfig{
+				Type:          config.LifecycleCommand,
+				StopCommand:   "true",
+				StartCommand:  "true",
+				StatusCommand: "false",
+			},
+			healthy: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newStatusServer(t, 100)
+			server.set(tt.status)
+
+			cfg := &config.NodeConfig{}
+			cfg.Node.RPCEndpoint = server.URL
+			cfg.Node.Lifecycle = tt.lifecycle
+			svc := NewService(cfg, zap.NewNop())
+
+			err := svc.checkHealth(context.Background())
+			switch {
+			case tt.healthy && err != nil:
+				t.Errorf("checkHealth() = %v, want healthy", err)
+			case !tt.healthy && !errors.Is(err, ErrNodeUnhealthy):
+				t.Errorf("checkHealth() = %v, want ErrNodeUnhealthy", err)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Minute, 5*time.Minute)
+
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, b.next())
+	}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delays = %v, want %v", got, want)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d != time.Minute {
+		t.Errorf("delay after reset = %s, want 1m", d)
+	}
+
+	// Zero settings use the defaults
+	b = newBackoff(0, 0)
+	if d := b.next(); d != defaultRetryInterval {
+		t.Errorf("default delay = %s, want %s", d, defaultRetryInterval)
+	}
+}
+
+// newTriggerService creates a daemon for a node snapshotted every 50 blocks into
+// a local destination, whose trigger at 50 was taken before a restart
+func newTriggerService(t *testing.T, rpcEndpoint string) (*Service, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	cfg := &config.NodeConfig{Name: t.Name()}
+	cfg.Node.HomeDir = filepath.Join(root, "home")
+	cfg.Node.DataDir = "data"
+	cfg.Node.ChainID = "test-1"
+	cfg.Node.RPCEndpoint = rpcEndpoint
+	cfg.Snapshot.TempDir = filepath.Join(root, "tmp")
+	cfg.Snapshot.Compression = "none"
+	cfg.Snapshot.HeightInterval = 50
+	cfg.Snapshot.HeightPollInterval = 10 * time.Millisecond
+	cfg.Snapshot.HealthCheck.RetryInterval = 20 * time.Millisecond
+	cfg.Snapshot.HealthCheck.MaxRetryInterval = 50 * time.Millisecond
+	cfg.Destinations = []config.DestinationConfig{{
+		Name:          "local",
+		PathPrefix:    "snapshots",
+		StorageConfig: config.StorageConfig{Type: config.StorageLocal, Path: filepath.Join(root, "store")},
+	}}
+	if err := os.MkdirAll(cfg.GetNodeDataPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.GetNodeDataPath(), "data"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewService(cfg, zap.NewNop())
+	if err := svc.writeState(&daemonState{LastHeightTrigger: 50}); err != nil {
+		t.Fatal(err)
+	}
+
+	return svc, root
+}
+
+// runDaemon runs the daemon until the test ends
+func runDaemon(t *testing.T, svc *Service) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- svc.Run(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// waitForHeightTrigger waits until the daemon persisted the height trigger
+func waitForHeightTrigger(t *testing.T, svc *Service, height int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, err := svc.readState()
+		if err == nil && state.LastHeightTrigger == height {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("height trigger %d was not recorded: %+v, %v", height, state, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunRetriesSkippedHeightTrigger(t *testing.T) {
+	server := newStatusServer(t, 120)
+	server.set(func(s *statusServer) { s.catchingUp = true })
+	svc, _ := newTriggerService(t, server.URL)
+	runDaemon(t, svc)
+
+	// Let the run triggered at 100 be skipped, then bring the node in sync
+	time.Sleep(100 * time.Millisecond)
+	if state, err := svc.readState(); err != nil || state.LastHeightTrigger != 50 {
+		t.Fatalf("state after skipped run = %+v, %v", state, err)
+	}
+	server.set(func(s *statusServer) { s.catchingUp = false })
+
+	waitForHeightTrigger(t, svc, 100)
+}
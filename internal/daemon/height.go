@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/rpc"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultHeightPollInterval is how often the node height is checked, about a block
+	defaultHeightPollInterval = 5 * time.Second
+
+	// heightRPCTimeout bounds a single height query
+	heightRPCTimeout = 10 * time.Second
+)
+
+// heightTriggers are the block heights a node is snapshotted at
+type heightTriggers struct {
+	every int64
+	at    []int64
+}
+
+// next returns the first trigger height above height, or 0 when none is left
+func (t *heightTriggers) next(height int64) int64 {
+	var next int64
+	if t.every > 0 {
+		next = (height/t.every + 1) * t.every
+	}
+
+	// at is sorted, the first height above is the closest one
+	for _, at := range t.at {
+		if at > height {
+			if next == 0 || at < next {
+				next = at
+			}
+			break
+		}
+	}
+
+	return next
+}
+
+// watchHeight polls the node height and queues the trigger height on fire each
+// time the chain reaches the next trigger above last. A queued trigger is not
+// queued again; last only moves past it once done reports its run succeeded,
+// failed runs are retried by the daemon. A zero last starts from the first
+// height seen, so boundaries passed before the daemon started don't fire.
+func (s *Service) watchHeight(ctx context.Context, last int64, fire chan<- int64, done <-chan struct{}) {
+	triggers := &heightTriggers{
+		every: s.cfg.Snapshot.HeightInterval,
+		at:    slices.Clone(s.cfg.Snapshot.Heights),
+	}
+	slices.Sort(triggers.at)
+
+	pollInterval := s.cfg.Snapshot.HeightPollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultHeightPollInterval
+	}
+
+	client := rpc.NewClient(s.cfg.Node.RPCEndpoint, heightRPCTimeout)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	// firedAt is the height the queued trigger fired at, until its run succeeds
+	var firedAt int64
+
+	failing := false
+	for {
+		status, err := client.Status(ctx)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return
+		case err != nil:
+			// Only log the first of a series of failures
+			if !failing {
+				s.logger.Warn("Failed to query node height", zap.Error(err))
+			}
+			failing = true
+		default:
+			if failing {
+				s.logger.Info("Node height is available again")
+			}
+			failing = false
+
+			height := status.SyncInfo.LatestBlockHeight
+			if last == 0 {
+				last = height
+			}
+
+			target := triggers.next(last)
+			s.setHeights(height, target)
+			if target == 0 {
+				s.logger.Info("No block height triggers left")
+				return
+			}
+
+			// Several boundaries crossed at once fire a single run
+			if firedAt == 0 && height >= target {
+				select {
+				case fire <- target:
+					s.logger.Info("Block height reached snapshot trigger",
+						zap.Int64("trigger", target),
+						zap.Int64("height", height))
+					firedAt = height
+				default:
+					// A triggered run is still queued, try again on the next poll
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			// The run covered every boundary up to the height it fired at
+			if firedAt > 0 {
+				last, firedAt = firedAt, 0
+			}
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"go.uber.org/zap"
+)
+
+func TestHeightTriggersNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		triggers heightTriggers
+		height   int64
+		want     int64
+	}{
+		{"interval below boundary", heightTriggers{every: 1000}, 1500, 2000},
+		{"interval on boundary", heightTriggers{every: 1000}, 2000, 3000},
+		{"interval from zero", heightTriggers{every: 1000}, 0, 1000},
+		{"heights next above", heightTriggers{at: []int64{100, 200, 300}}, 150, 200},
+		{"heights on a height", heightTriggers{at: []int64{100, 200, 300}}, 200, 300},
+		{"heights all passed", heightTriggers{at: []int64{100, 200, 300}}, 300, 0},
+		{"no triggers", heightTriggers{}, 150, 0},
+		{"height before interval", heightTriggers{every: 1000, at: []int64{1200}}, 1100, 1200},
+		{"interval before height", heightTriggers{every: 1000, at: []int64{2500}}, 1100, 2000},
+		{"interval after heights passed", heightTriggers{every: 1000, at: []int64{500}}, 1100, 2000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.triggers.next(tt.height); got != tt.want {
+				t.Errorf("next(%d) = %d, want %d", tt.height, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchHeight(t *testing.T) {
+	server := newStatusServer(t, 120)
+	cfg := &config.NodeConfig{}
+	cfg.Node.RPCEndpoint = server.URL
+	cfg.Snapshot.HeightInterval = 50
+	cfg.Snapshot.HeightPollInterval = 5 * time.Millisecond
+	svc := NewService(cfg, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fire := make(chan int64, 1)
+	done := make(chan struct{}, 1)
+	go svc.watchHeight(ctx, 50, fire, done)
+
+	expectFire := func(want int64) {
+		t.Helper()
+		select {
+		case got := <-fire:
+			if got != want {
+				t.Fatalf("fired %d, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("trigger %d did not fire", want)
+		}
+	}
+	expectQuiet := func() {
+		t.Helper()
+		select {
+		case got := <-fire:
+			t.Fatalf("fired %d again before the run succeeded", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	expectFire(100)
+
+	// Until the run succeeds the trigger is not queued again, even when the
+	// chain passes the next boundary
+	expectQuiet()
+	server.set(func(s *statusServer) { s.height = 160 })
+	expectQuiet()
+
+	// Success moves past the height the trigger fired at, 150 is due now
+	done <- struct{}{}
+	expectFire(150)
+}
+
+func TestRunRetriesFailedHeightTrigger(t *testing.T) {
+	server := newStatusServer(t, 120)
+	svc, root := newTriggerService(t, server.URL)
+
+	// The destination can't be written until the file in its place is gone
+	store := filepath.Join(root, "store")
+	if err := os.WriteFile(store, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	runDaemon(t, svc)
+
+	time.Sleep(100 * time.Millisecond)
+	if state, err := svc.readState(); err != nil || state.LastHeightTrigger != 50 {
+		t.Fatalf("state after failed run = %+v, %v", state, err)
+	}
+	if err := os.Remove(store); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForHeightTrigger(t, svc, 100)
+}
@@ -0,0 +1,85 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+)
+
+// Limits caps the archive jobs and uploads that run at the same time across all
+// daemon services of a process. A zero limit means no limit.
+type Limits struct {
+	archives semaphore
+	uploads  semaphore
+
+	// streams serializes taking several upload slots at once
+	streams sync.Mutex
+}
+
+// NewLimits creates limits allowing the given numbers of concurrent archive jobs and uploads
+func NewLimits(archives, uploads int) *Limits {
+	return &Limits{
+		archives: newSemaphore(archives),
+		uploads:  newSemaphore(uploads),
+	}
+}
+
+// acquireUploads takes an upload slot for each of n concurrent uploads, capped at
+// the limit so a run with more destinations than slots can still start. It
+// returns the number of slots taken.
+func (l *Limits) acquireUploads(ctx context.Context, n int) (int, error) {
+	if l.uploads == nil {
+		return 0, ctx.Err()
+	}
+	n = min(n, cap(l.uploads))
+
+	// Two runs each holding part of the slots would wait for each other forever
+	l.streams.Lock()
+	defer l.streams.Unlock()
+
+	for i := 0; i < n; i++ {
+		if err := l.uploads.acquire(ctx); err != nil {
+			l.releaseUploads(i)
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// releaseUploads frees n slots taken by acquireUploads
+func (l *Limits) releaseUploads(n int) {
+	for i := 0; i < n; i++ {
+		l.uploads.release()
+	}
+}
+
+// semaphore is a counting semaphore; a nil semaphore never blocks
+type semaphore chan struct{}
+
+// newSemaphore creates a semaphore with n slots, or nil for no limit
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits for a free slot or until ctx is done
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return ctx.Err()
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,47 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcquireUploads(t *testing.T) {
+	ctx := context.Background()
+
+	// More destinations than slots takes every slot
+	limits := NewLimits(0, 2)
+	n, err := limits.acquireUploads(ctx, 3)
+	if err != nil || n != 2 {
+		t.Fatalf("acquireUploads = %d, %v, want 2 slots", n, err)
+	}
+
+	// A second run waits until the first one is done and gives up with its context
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := limits.acquireUploads(waitCtx, 1); err == nil {
+		t.Fatal("acquired an upload slot while all slots were taken")
+	}
+
+	limits.releaseUploads(n)
+	if len(limits.uploads) != 0 {
+		t.Fatalf("%d slots still taken after release", len(limits.uploads))
+	}
+
+	// A run that gives up midway frees what it took
+	limits.uploads.acquire(ctx)
+	waitCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := limits.acquireUploads(waitCtx, 2); err == nil {
+		t.Fatal("acquired two upload slots while one was taken")
+	}
+	if len(limits.uploads) != 1 {
+		t.Fatalf("%d slots taken after a failed acquire, want 1", len(limits.uploads))
+	}
+
+	// Without a limit nothing is taken
+	n, err = NewLimits(0, 0).acquireUploads(ctx, 3)
+	if err != nil || n != 0 {
+		t.Fatalf("acquireUploads without limit = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// stateFile holds the last successful run of a node in its snapshot directory
+const stateFile = "daemon-state.json"
+
+// scheduler decides when the next snapshot run of a node starts
+type scheduler struct {
+	interval time.Duration
+	cron     cron.Schedule
+	jitter   time.Duration
+}
+
+// enabled reports whether runs are scheduled by time
+func (sc *scheduler) enabled() bool {
+	return sc.cron != nil || sc.interval > 0
+}
+
+// next returns the start of the run after one that started at last. Without a
+// previous run an interval schedule starts right away and a cron schedule waits
+// for its next slot. A slot missed since last is due immediately.
+func (sc *scheduler) next(last, now time.Time) time.Time {
+	var next time.Time
+	switch {
+	case sc.cron != nil && last.IsZero():
+		next = sc.cron.Next(now)
+	case sc.cron != nil:
+		next = sc.cron.Next(last)
+	case last.IsZero():
+		next = now
+	default:
+		next = last.Add(sc.interval)
+	}
+
+	if next.Before(now) {
+		next = now
+	}
+
+	// Spread runs of nodes sharing a schedule
+	if sc.jitter > 0 {
+		next = next.Add(rand.N(sc.jitter))
+	}
+
+	return next
+}
+
+// daemonState is what a node's daemon persists across restarts
+type daemonState struct {
+	LastSuccess       *RunStatus `json:"last_success"`
+	LastHeightTrigger int64      `json:"last_height_trigger,omitempty"`
+}
+
+// readState reads the persisted state of the node, a missing file is an empty state
+func (s *Service) readState() (*daemonState, error) {
+	data, err := os.ReadFile(filepath.Join(s.cfg.GetSnapshotPath(), stateFile))
+	if os.IsNotExist(err) {
+		return &daemonState{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read daemon state: %w", err)
+	}
+
+	var state daemonState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode daemon state: %w", err)
+	}
+
+	return &state, nil
+}
+
+// writeState persists the state of the node
+func (s *Service) writeState(state *daemonState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode daemon state: %w", err)
+	}
+
+	if err := os.MkdirAll(s.cfg.GetSnapshotPath(), 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	// Replace the file atomically so a crash never leaves it truncated
+	path := filepath.Join(s.cfg.GetSnapshotPath(), stateFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write daemon state: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write daemon state: %w", err)
+	}
+
+	return nil
+}
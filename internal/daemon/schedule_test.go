@@ -0,0 +1,111 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+)
+
+// cronSchedule parses a schedule the way the daemon does
+func cronSchedule(t *testing.T, spec, timezone string) *scheduler {
+	t.Helper()
+
+	cfg := &config.NodeConfig{}
+	cfg.Snapshot.Schedule = spec
+	cfg.Snapshot.Timezone = timezone
+	schedule, err := cfg.CronSchedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &scheduler{cron: schedule}
+}
+
+func TestSchedulerNext(t *testing.T) {
+	// 21:00 in Tokyo, the next 03:00 slot there is 18:00 UTC
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tokyo := cronSchedule(t, "0 3 * * *", "Asia/Tokyo")
+
+	tests := []struct {
+		name  string
+		sched *scheduler
+		last  time.Time
+		want  time.Time
+	}{
+		{
+			name:  "cron without previous run waits for the next slot",
+			sched: tokyo,
+			want:  time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "cron resumes after the previous run",
+			sched: tokyo,
+			last:  time.Date(2024, 4, 30, 18, 0, 5, 0, time.UTC),
+			want:  time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "cron slot missed while stopped is due now",
+			sched: tokyo,
+			last:  time.Date(2024, 4, 29, 18, 0, 5, 0, time.UTC),
+			want:  now,
+		},
+		{
+			name:  "cron in local time of the timezone",
+			sched: cronSchedule(t, "30 14 * * *", "Europe/Berlin"),
+			last:  time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "interval without previous run starts now",
+			sched: &scheduler{interval: 6 * time.Hour},
+			want:  now,
+		},
+		{
+			name:  "interval resumes after the previous run",
+			sched: &scheduler{interval: 6 * time.Hour},
+			last:  now.Add(-time.Hour),
+			want:  now.Add(5 * time.Hour),
+		},
+		{
+			name:  "interval overdue after a long stop is due now",
+			sched: &scheduler{interval: 6 * time.Hour},
+			last:  now.Add(-7 * time.Hour),
+			want:  now,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sched.next(tt.last, now); !got.Equal(tt.want) {
+				t.Errorf("next = %s, want %s", got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	jitter := 10 * time.Minute
+	sched := &scheduler{interval: time.Hour, jitter: jitter}
+	base := now.Add(30 * time.Minute)
+
+	var spread bool
+	for i := 0; i < 1000; i++ {
+		got := sched.next(now.Add(-30*time.Minute), now)
+		if got.Before(base) || !got.Before(base.Add(jitter)) {
+			t.Fatalf("next = %s, want within [%s, %s)", got, base, base.Add(jitter))
+		}
+		spread = spread || !got.Equal(base)
+	}
+	if !spread {
+		t.Error("jitter never delayed a run")
+	}
+
+	// An overdue run is delayed from now, never scheduled in the past
+	got := sched.next(now.Add(-2*time.Hour), now)
+	if got.Before(now) || !got.Before(now.Add(jitter)) {
+		t.Errorf("overdue next = %s, want within [%s, %s)", got, now, now.Add(jitter))
+	}
+}
@@ -2,22 +2,32 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/q163i/snapshot-cosmos/internal/config"
-	"github.com/q163i/snapshot-cosmos/internal/s3"
+	"github.com/q163i/snapshot-cosmos/internal/metrics"
+	"github.com/q163i/snapshot-cosmos/internal/retention"
 	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
 	"go.uber.org/zap"
 )
 
 // Service handles the daemon functionality
 type Service struct {
-	cfg         *config.NodeConfig
-	logger      *zap.Logger
-	snapshotSvc *snapshot.Service
-	s3Svc       *s3.Service
+	cfg          *config.NodeConfig
+	logger       *zap.Logger
+	snapshotSvc  *snapshot.Service
+	destinations []*destination
+	metrics      *metrics.Node
+	state        runState
+	trigger      chan struct{}
+	limits       *Limits
+	persisted    daemonState
 }
 
 // NewService creates a new daemon service
@@ -26,98 +36,506 @@ func NewService(cfg *config.NodeConfig, logger *zap.Logger) *Service {
 		cfg:         cfg,
 		logger:      logger,
 		snapshotSvc: snapshot.NewService(cfg, logger),
-		s3Svc:       s3.NewService(cfg, logger),
+		metrics:     metrics.ForNode(cfg.Name),
+		trigger:     make(chan struct{}, 1),
+		limits:      NewLimits(0, 0),
 	}
 }
 
+// SetLimits shares concurrency limits with other services of the process.
+// It must be called before Run.
+func (s *Service) SetLimits(limits *Limits) {
+	s.limits = limits
+}
+
 // Run runs the daemon service
 func (s *Service) Run(ctx context.Context) error {
 	s.logger.Info("Starting snapshot daemon",
 		zap.String("chain_id", s.cfg.Node.ChainID),
-		zap.Duration("interval", s.cfg.Snapshot.Interval))
+		zap.Duration("interval", s.cfg.Snapshot.Interval),
+		zap.String("schedule", s.cfg.Snapshot.Schedule))
+
+	// Parse the schedule
+	cronSchedule, err := s.cfg.CronSchedule()
+	if err != nil {
+		return err
+	}
+	sched := &scheduler{
+		interval: s.cfg.Snapshot.Interval,
+		cron:     cronSchedule,
+		jitter:   s.cfg.Snapshot.Jitter,
+	}
+
+	// Open snapshot destinations
+	if err := s.openDestinations(); err != nil {
+		return err
+	}
 
-	// Create ticker for periodic snapshots
-	ticker := time.NewTicker(s.cfg.Snapshot.Interval)
-	defer ticker.Stop()
+	// Abort uploads left behind by previous runs
+	staleUploadAge := s.cfg.Snapshot.StaleUploadAge
+	if staleUploadAge == 0 {
+		staleUploadAge = defaultStaleUploadAge
+	}
+	for _, dest := range s.destinations {
+		if cleaner, ok := dest.store.(storage.UploadCleaner); ok {
+			if err := cleaner.AbortStaleUploads(ctx, dest.PathPrefix+"/", s.cfg.GetSnapshotPath(), staleUploadAge); err != nil {
+				s.logger.Warn("Failed to abort stale uploads",
+					zap.String("destination", dest.Name),
+					zap.Error(err))
+			}
+		}
+	}
+
+	// Resume the schedule from the last successful run
+	state, err := s.readState()
+	if err != nil {
+		s.logger.Warn("Ignoring unreadable daemon state", zap.Error(err))
+	} else {
+		s.persisted = *state
+	}
+	if s.persisted.LastSuccess != nil {
+		s.restoreLastSuccess(s.persisted.LastSuccess)
+		s.metrics.LastSuccess(s.persisted.LastSuccess.Finished)
+	}
 
-	// Run initial snapshot
-	if err := s.runSnapshot(); err != nil {
-		s.logger.Error("Initial snapshot failed", zap.Error(err))
+	// Watch the chain height for height triggered snapshots
+	heightReached := make(chan int64, 1)
+	heightDone := make(chan struct{}, 1)
+	if s.cfg.HasHeightTriggers() {
+		go s.watchHeight(ctx, s.persisted.LastHeightTrigger, heightReached, heightDone)
 	}
 
+	s.setReady(true)
+	defer s.setReady(false)
+
+	// Runs skipped because the node is unhealthy and failed height triggered runs
+	// are retried with backoff
+	retry := newBackoff(s.cfg.Snapshot.HealthCheck.RetryInterval, s.cfg.Snapshot.HealthCheck.MaxRetryInterval)
+	var retryAt time.Time
+
+	// A height trigger stays pending until a run covering it succeeds
+	var pendingHeight int64
+
 	// Main loop
 	for {
+		// Without a time schedule or pending retry only height triggers and
+		// requests start runs
+		var scheduled <-chan time.Time
+		stopTimer := func() bool { return false }
+		if sched.enabled() || !retryAt.IsZero() {
+			next := retryAt
+			if sched.enabled() {
+				if scheduledAt := sched.next(s.lastStarted(), time.Now()); next.IsZero() || scheduledAt.Before(next) {
+					next = scheduledAt
+				}
+			}
+			s.setNextRun(next)
+			s.logger.Info("Next snapshot scheduled", zap.Time("at", next))
+			timer := time.NewTimer(time.Until(next))
+			scheduled, stopTimer = timer.C, timer.Stop
+		}
+
+		var trigger string
 		select {
 		case <-ctx.Done():
+			stopTimer()
 			s.logger.Info("Daemon stopped by context cancellation")
 			return nil
-		case <-ticker.C:
-			if err := s.runSnapshot(); err != nil {
-				s.logger.Error("Periodic snapshot failed", zap.Error(err))
+		case <-scheduled:
+			trigger = "schedule"
+			if !retryAt.IsZero() && !time.Now().Before(retryAt) {
+				trigger = "retry"
+			}
+		case height := <-heightReached:
+			stopTimer()
+			trigger = "height"
+			pendingHeight = max(pendingHeight, height)
+		case <-s.trigger:
+			stopTimer()
+			trigger = "request"
+			s.logger.Info("Running requested snapshot")
+		}
+
+		err := s.runSnapshot(ctx)
+		switch {
+		case errors.Is(err, ErrNodeUnhealthy):
+			delay := retry.next()
+			retryAt = time.Now().Add(delay)
+			s.logger.Warn("Skipped snapshot of unhealthy node",
+				zap.String("trigger", trigger),
+				zap.Int64("pending_height", pendingHeight),
+				zap.Duration("retry_in", delay),
+				zap.Error(err))
+		case err != nil && pendingHeight > 0:
+			// Retry the height trigger rather than waiting for the next one
+			delay := retry.next()
+			retryAt = time.Now().Add(delay)
+			s.logger.Error("Snapshot failed",
+				zap.String("trigger", trigger),
+				zap.Int64("pending_height", pendingHeight),
+				zap.Duration("retry_in", delay),
+				zap.Error(err))
+		case err != nil:
+			retry.reset()
+			retryAt = time.Time{}
+			s.logger.Error("Snapshot failed", zap.String("trigger", trigger), zap.Error(err))
+		default:
+			retry.reset()
+			retryAt = time.Time{}
+		}
+
+		// Remember a height trigger once it was snapshotted, so a restart neither
+		// repeats it nor skips one whose run failed
+		if err == nil && pendingHeight > 0 {
+			s.persisted.LastHeightTrigger = pendingHeight
+			pendingHeight = 0
+			if err := s.writeState(&s.persisted); err != nil {
+				s.logger.Warn("Failed to persist daemon state", zap.Error(err))
+			}
+
+			// Let the watcher move on to the next trigger
+			select {
+			case heightDone <- struct{}{}:
+			default:
 			}
 		}
 	}
 }
 
-// runSnapshot creates a snapshot and uploads it to S3
-func (s *Service) runSnapshot() error {
+// runSnapshot creates a snapshot of a healthy node, uploads it to every
+// destination and records the outcome of the run
+func (s *Service) runSnapshot(ctx context.Context) error {
+	s.startRun()
+
+	// Only snapshot a node that is in sync and producing blocks
+	err := s.checkHealth(ctx)
+	if err == nil {
+		err = s.createSnapshot(ctx)
+	}
+
+	run := s.finishRun(err)
+	if errors.Is(err, ErrNodeUnhealthy) {
+		s.metrics.RunSkipped()
+	} else {
+		s.metrics.RunFinished(err)
+	}
+
+	// Remember the run so a restarted daemon resumes the schedule
+	if err == nil {
+		s.persisted.LastSuccess = run
+		if err := s.writeState(&s.persisted); err != nil {
+			s.logger.Warn("Failed to persist daemon state", zap.Error(err))
+		}
+	}
+
+	return err
+}
+
+// createSnapshot creates a snapshot and uploads it to every destination
+func (s *Service) createSnapshot(ctx context.Context) error {
 	s.logger.Info("Starting periodic snapshot",
 		zap.String("chain_id", s.cfg.Node.ChainID))
 
+	// Bound the whole run, including uploads and cleanup
+	if s.cfg.Snapshot.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.Snapshot.Timeout)
+		defer cancel()
+	}
+
+	// Retry archives that did not reach every required destination last time
+	s.retryPendingUploads(ctx)
+
+	// Create and upload snapshot
+	var snapshotPath string
+	var results []uploadResult
+	var err error
+	if s.cfg.Snapshot.Stream {
+		snapshotPath, results, err = s.streamSnapshot(ctx)
+	} else {
+		snapshotPath, results, err = s.createAndUpload(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.reportUploads(results)
+
+	// Apply the retention policies
+	s.cleanup(ctx)
+
+	if failed := failedRequired(results); len(failed) > 0 {
+		return fmt.Errorf("snapshot %s did not reach required destinations: %s",
+			snapshotPath, strings.Join(failed, ", "))
+	}
+	if !storedAnywhere(results) {
+		return fmt.Errorf("snapshot %s did not reach any destination", snapshotPath)
+	}
+
+	s.logger.Info("Periodic snapshot completed successfully",
+		zap.String("snapshot_path", snapshotPath),
+		zap.Int("destinations", len(results)))
+
+	return nil
+}
+
+// createAndUpload creates a local snapshot file and uploads it to every destination.
+// The archive is marked pending while a required destination is missing it.
+func (s *Service) createAndUpload(ctx context.Context) (string, []uploadResult, error) {
+	// Wait until archiving does not exceed the process limit
+	s.setPhase(phaseWaiting)
+	if err := s.limits.archives.acquire(ctx); err != nil {
+		return "", nil, fmt.Errorf("failed to wait for an archive slot: %w", err)
+	}
+
 	// Create snapshot
-	snapshotPath, err := s.snapshotSvc.Create()
+	s.setPhase(metrics.PhaseArchive)
+	start := time.Now()
+	snapshotPath, err := s.snapshotSvc.Create(ctx, snapshot.CreateOptions{})
+	s.limits.archives.release()
 	if err != nil {
-		return fmt.Errorf("failed to create snapshot: %w", err)
+		s.metrics.Error(metrics.PhaseArchive)
+		return "", nil, fmt.Errorf("failed to create snapshot: %w", err)
 	}
+	s.metrics.ObservePhase(metrics.PhaseArchive, time.Since(start))
 
-	// Upload to S3
-	fileName := filepath.Base(snapshotPath)
-	s3Key := fmt.Sprintf("%s/%s", s.cfg.S3.PathPrefix, fileName)
+	if info, err := os.Stat(snapshotPath); err == nil {
+		s.recordArchive(snapshotPath, info.Size())
+	}
+
+	// Upload to all destinations
+	s.setPhase(metrics.PhaseUpload)
+	results := s.uploadToAll(ctx, snapshotPath, s.destinations)
 
-	if err := s.s3Svc.Upload(snapshotPath, s3Key); err != nil {
-		return fmt.Errorf("failed to upload snapshot: %w", err)
+	if failed := failedRequired(results); len(failed) > 0 {
+		if err := writePending(snapshotPath, failed); err != nil {
+			s.logger.Error("Failed to mark snapshot as pending", zap.Error(err))
+		}
 	}
 
+	return snapshotPath, results, nil
+}
+
+// streamSnapshot streams the snapshot archive straight into every destination,
+// so no local disk space is needed for the archive
+func (s *Service) streamSnapshot(ctx context.Context) (string, []uploadResult, error) {
+	var fanout *fanoutWriter
+
+	// A streamed run archives and uploads at once, it counts as an archive job
+	// and as an upload to every destination
+	s.setPhase(phaseWaiting)
+	if err := s.limits.archives.acquire(ctx); err != nil {
+		return "", nil, fmt.Errorf("failed to wait for an archive slot: %w", err)
+	}
+	defer s.limits.archives.release()
+
+	uploads, err := s.limits.acquireUploads(ctx, len(s.destinations))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to wait for upload slots: %w", err)
+	}
+	defer s.limits.releaseUploads(uploads)
+
+	s.setPhase(metrics.PhaseArchive)
+	start := time.Now()
+	snapshotPath, err := s.snapshotSvc.Stream(ctx, func(name string, format snapshot.Format) (snapshot.ArchiveWriter, error) {
+		var err error
+		fanout, err = s.newFanoutWriter(ctx, name, format.ContentType())
+		if err != nil {
+			return nil, err
+		}
+		return fanout, nil
+	})
+	if err != nil {
+		s.metrics.Error(metrics.PhaseArchive)
+		return "", nil, fmt.Errorf("failed to stream snapshot: %w", err)
+	}
+	s.metrics.ObservePhase(metrics.PhaseArchive, time.Since(start))
+	s.recordArchive(snapshotPath, fanout.written)
+
+	// Upload sidecars to the destinations that received the archive
+	s.setPhase(metrics.PhaseUpload)
+	results := fanout.results()
+	s.uploadSidecarsToAll(ctx, snapshotPath, results)
+
+	// Drop the local sidecars, there is no local archive they belong to
+	for _, sidecar := range snapshot.Sidecars(snapshotPath) {
+		if err := os.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+			s.logger.Warn("Failed to remove local sidecar", zap.String("file", sidecar), zap.Error(err))
+		}
+	}
+
+	return snapshotPath, results, nil
+}
+
+// recordArchive records the name, size and block height of a new archive
+func (s *Service) recordArchive(snapshotPath string, size int64) {
+	s.setSnapshot(snapshotPath)
+	name, _ := snapshot.ParseName(s.cfg.Node.ChainID, filepath.Base(snapshotPath))
+	s.metrics.Archive(size, name.Height)
+}
+
+// cleanup applies the retention policies to the local snapshot directory and
+// every destination, recording deletions and what is left at each destination
+func (s *Service) cleanup(ctx context.Context) {
+	s.setPhase(metrics.PhaseCleanup)
+	start := time.Now()
+	defer func() {
+		s.metrics.ObservePhase(metrics.PhaseCleanup, time.Since(start))
+	}()
+
 	// Cleanup old snapshots
-	if err := s.snapshotSvc.Cleanup(); err != nil {
+	decisions, err := s.snapshotSvc.Prune(ctx, false)
+	if err != nil {
+		s.metrics.Error(metrics.PhaseCleanup)
 		s.logger.Warn("Failed to cleanup old snapshots", zap.Error(err))
 	}
+	s.metrics.Deleted(metrics.TargetSnapshotDir, countDeleted(decisions))
+
+	// Cleanup old stored snapshots
+	for _, dest := range s.destinations {
+		decisions, err := s.pruneStored(ctx, dest, false)
+		if err != nil {
+			s.metrics.Error(metrics.PhaseCleanup)
+			s.logger.Warn("Failed to cleanup old stored snapshots",
+				zap.String("destination", dest.Name),
+				zap.Error(err))
+			continue
+		}
+		s.metrics.Deleted(dest.Name, countDeleted(decisions))
 
-	// Cleanup old S3 snapshots
-	if err := s.cleanupOldS3Snapshots(); err != nil {
-		s.logger.Warn("Failed to cleanup old S3 snapshots", zap.Error(err))
+		var objects int
+		var size int64
+		for _, decision := range decisions {
+			if decision.Keep {
+				objects++
+				size += decision.Size
+			}
+		}
+		s.metrics.Stored(dest.Name, objects, size)
 	}
+}
 
-	s.logger.Info("Periodic snapshot completed successfully",
-		zap.String("snapshot_path", snapshotPath),
-		zap.String("s3_key", s3Key))
+// countDeleted returns the number of archives the decisions removed
+func countDeleted(decisions []retention.Decision) int {
+	var deleted int
+	for _, decision := range decisions {
+		if !decision.Keep {
+			deleted++
+		}
+	}
+	return deleted
+}
 
-	return nil
+// PruneReport holds the retention decisions for the local snapshot directory or a destination
+type PruneReport struct {
+	Target    string
+	Decisions []retention.Decision
+}
+
+// Prune applies the retention policies to the local snapshot directory and every
+// destination. With dryRun nothing is deleted.
+func (s *Service) Prune(ctx context.Context, dryRun bool) ([]PruneReport, error) {
+	if s.destinations == nil {
+		if err := s.openDestinations(); err != nil {
+			return nil, err
+		}
+	}
+
+	decisions, err := s.snapshotSvc.Prune(ctx, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune local snapshots: %w", err)
+	}
+	reports := []PruneReport{{Target: "local", Decisions: decisions}}
+
+	for _, dest := range s.destinations {
+		decisions, err := s.pruneStored(ctx, dest, dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prune destination %s: %w", dest.Name, err)
+		}
+		reports = append(reports, PruneReport{Target: dest.Name, Decisions: decisions})
+	}
+
+	return reports, nil
 }
 
-// cleanupOldS3Snapshots removes old snapshots from S3 based on retention policy
-func (s *Service) cleanupOldS3Snapshots() error {
-	prefix := fmt.Sprintf("%s/", s.cfg.S3.PathPrefix)
+// listStoredArchives returns the archives of this chain at a destination.
+// Sidecars and foreign objects under the prefix are ignored.
+func (s *Service) listStoredArchives(ctx context.Context, dest *destination, store storage.Backend) ([]retention.Item, error) {
+	prefix := fmt.Sprintf("%s/", dest.PathPrefix)
 
-	// List snapshots in S3
-	keys, err := s.s3Svc.List(prefix)
+	objects, err := store.List(ctx, prefix)
 	if err != nil {
-		return fmt.Errorf("failed to list S3 snapshots: %w", err)
+		return nil, fmt.Errorf("failed to list stored snapshots: %w", err)
+	}
+
+	var archives []retention.Item
+	for _, object := range objects {
+		name, ok := snapshot.ParseName(s.cfg.Node.ChainID, strings.TrimPrefix(object.Key, prefix))
+		if !ok || snapshot.IsSidecar(object.Key) {
+			continue
+		}
+		archives = append(archives, retention.Item{
+			Key:    object.Key,
+			Time:   name.Time,
+			Height: name.Height,
+			Size:   object.Size,
+		})
 	}
 
-	// If we have more snapshots than retention limit, remove oldest ones
-	if len(keys) > s.cfg.Snapshot.Retention {
-		keysToRemove := len(keys) - s.cfg.Snapshot.Retention
-		for i := 0; i < keysToRemove; i++ {
-			if err := s.s3Svc.Delete(keys[i]); err != nil {
-				s.logger.Error("Failed to delete old S3 snapshot",
-					zap.String("key", keys[i]),
+	return archives, nil
+}
+
+// pruneStored applies the retention policy of a destination and returns the
+// decision for every archive. With dryRun nothing is deleted. Archives that could
+// not be deleted are reported as kept.
+func (s *Service) pruneStored(ctx context.Context, dest *destination, dryRun bool) ([]retention.Decision, error) {
+	// List and delete over a single connection
+	store, err := storage.OpenSession(ctx, dest.store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to destination: %w", err)
+	}
+	defer store.Close()
+
+	archives, err := s.listStoredArchives(ctx, dest, store)
+	if err != nil {
+		return nil, err
+	}
+
+	decisions := retention.Plan(dest.RetentionPolicy, archives, time.Now())
+	if dryRun {
+		return decisions, nil
+	}
+
+	// Remove archives the policy does not keep, together with their sidecars
+	for i, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+
+		if err := store.Delete(ctx, decision.Key); err != nil {
+			s.logger.Error("Failed to delete old stored snapshot",
+				zap.String("destination", dest.Name),
+				zap.String("key", decision.Key),
+				zap.Error(err))
+			decisions[i].Keep = true
+			decisions[i].Reason = "deletion failed"
+			continue
+		}
+		s.logger.Info("Removed old stored snapshot",
+			zap.String("destination", dest.Name),
+			zap.String("key", decision.Key),
+			zap.Int64("height", decision.Height),
+			zap.String("reason", decision.Reason))
+
+		for _, sidecar := range snapshot.Sidecars(decision.Key) {
+			if err := store.Delete(ctx, sidecar); err != nil {
+				s.logger.Warn("Failed to delete stored snapshot sidecar",
+					zap.String("destination", dest.Name),
+					zap.String("key", sidecar),
 					zap.Error(err))
-			} else {
-				s.logger.Info("Removed old S3 snapshot", zap.String("key", keys[i]))
 			}
 		}
 	}
 
-	return nil
+	return decisions, nil
 }
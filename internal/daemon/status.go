@@ -0,0 +1,244 @@
+package daemon
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/metrics"
+)
+
+// phaseWaiting is the phase of a run waiting for a free archive slot
+const phaseWaiting = "waiting"
+
+// ErrSnapshotRunning is returned when a snapshot is requested while one is running or queued
+var ErrSnapshotRunning = errors.New("a snapshot run is already in progress")
+
+// Status is the state of a node's snapshot runs
+type Status struct {
+	Node         string           `json:"node"`
+	ChainID      string           `json:"chain_id"`
+	Ready        bool             `json:"ready"`
+	Phase        string           `json:"phase,omitempty"`
+	PhaseStarted *time.Time       `json:"phase_started,omitempty"`
+	Archive      *ArchiveProgress `json:"archive_progress,omitempty"`
+	Upload       *UploadProgress  `json:"upload_progress,omitempty"`
+	LastRun      *RunStatus       `json:"last_run,omitempty"`
+	NextRun      *time.Time       `json:"next_run,omitempty"`
+	Height       int64            `json:"height,omitempty"`
+	NextHeight   int64            `json:"next_height,omitempty"`
+}
+
+// ArchiveProgress is how much of the data directory has been archived so far
+type ArchiveProgress struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// UploadProgress is how many destinations the running upload has finished
+type UploadProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// Outcomes of a snapshot run
+const (
+	RunSucceeded        = "success"
+	RunFailed           = "failure"
+	RunSkippedUnhealthy = "skipped: unhealthy"
+)
+
+// RunStatus is the outcome of a finished snapshot run
+type RunStatus struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Snapshot string    `json:"snapshot,omitempty"`
+	Success  bool      `json:"success"`
+	Result   string    `json:"result,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// runState tracks the snapshot runs of a service
+type runState struct {
+	mu           sync.Mutex
+	ready        bool
+	running      bool
+	started      time.Time
+	phase        string
+	phaseStarted time.Time
+	snapshot     string
+	uploaded     int
+	destinations int
+	lastRun      *RunStatus
+	nextRun      time.Time
+	height       int64
+	nextHeight   int64
+}
+
+// Status returns the current state of the node's snapshot runs
+func (s *Service) Status() Status {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	status := Status{
+		Node:       s.cfg.Name,
+		ChainID:    s.cfg.Node.ChainID,
+		Ready:      s.state.ready,
+		Phase:      s.state.phase,
+		LastRun:    s.state.lastRun,
+		Height:     s.state.height,
+		NextHeight: s.state.nextHeight,
+	}
+
+	if s.state.phase != "" {
+		phaseStarted := s.state.phaseStarted
+		status.PhaseStarted = &phaseStarted
+
+		switch {
+		case s.state.destinations > 0:
+			status.Upload = &UploadProgress{Done: s.state.uploaded, Total: s.state.destinations}
+		case s.state.phase == metrics.PhaseArchive:
+			progress := s.snapshotSvc.Progress()
+			status.Archive = &ArchiveProgress{Files: progress.Files, Bytes: progress.Bytes}
+		}
+	}
+
+	if !s.state.nextRun.IsZero() {
+		nextRun := s.state.nextRun
+		status.NextRun = &nextRun
+	}
+
+	return status
+}
+
+// Trigger queues an immediate snapshot run. It fails with ErrSnapshotRunning
+// while a run is in progress or already queued.
+func (s *Service) Trigger() error {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	if s.state.running {
+		return ErrSnapshotRunning
+	}
+
+	select {
+	case s.trigger <- struct{}{}:
+		return nil
+	default:
+		return ErrSnapshotRunning
+	}
+}
+
+// Ready reports whether the service has opened its destinations and runs snapshots
+func (s *Service) Ready() bool {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	return s.state.ready
+}
+
+// setReady marks the service as ready to run snapshots
+func (s *Service) setReady(ready bool) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.ready = ready
+}
+
+// setNextRun records when the next scheduled run starts
+func (s *Service) setNextRun(next time.Time) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.nextRun = next
+}
+
+// setHeights records the latest node height and the next height trigger
+func (s *Service) setHeights(height, next int64) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.height = height
+	s.state.nextHeight = next
+}
+
+// startRun marks a snapshot run as started
+func (s *Service) startRun() {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.running = true
+	s.state.started = time.Now()
+	s.state.snapshot = ""
+}
+
+// finishRun records and returns the outcome of the running snapshot run
+func (s *Service) finishRun(err error) *RunStatus {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	run := &RunStatus{
+		Started:  s.state.started,
+		Finished: time.Now(),
+		Snapshot: s.state.snapshot,
+		Success:  err == nil,
+		Result:   RunSucceeded,
+	}
+	if err != nil {
+		run.Result = RunFailed
+		if errors.Is(err, ErrNodeUnhealthy) {
+			run.Result = RunSkippedUnhealthy
+		}
+		run.Error = err.Error()
+	}
+
+	s.state.lastRun = run
+	s.state.running = false
+	s.state.phase = ""
+	s.state.destinations = 0
+
+	return run
+}
+
+// restoreLastSuccess records a successful run of an earlier daemon process
+func (s *Service) restoreLastSuccess(run *RunStatus) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.started = run.Started
+	s.state.lastRun = run
+}
+
+// lastStarted returns when the last run started, zero before the first run
+func (s *Service) lastStarted() time.Time {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	return s.state.started
+}
+
+// setPhase records the phase the running snapshot run is in
+func (s *Service) setPhase(phase string) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.phase = phase
+	s.state.phaseStarted = time.Now()
+	s.state.uploaded = 0
+	s.state.destinations = 0
+}
+
+// setSnapshot records the archive the running snapshot run created
+func (s *Service) setSnapshot(snapshotPath string) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.snapshot = filepath.Base(snapshotPath)
+}
+
+// startUploads records that an upload to the given number of destinations started
+func (s *Service) startUploads(destinations int) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.uploaded = 0
+	s.state.destinations = destinations
+}
+
+// uploadDone records that the upload to one destination finished
+func (s *Service) uploadDone() {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.uploaded++
+}
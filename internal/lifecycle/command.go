@@ -0,0 +1,62 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+)
+
+// commandController manages the node with shell commands, e.g. systemctl or
+// supervisorctl. The status command exits with 0 while the node runs.
+type commandController struct {
+	stopCommand   string
+	startCommand  string
+	statusCommand string
+}
+
+// newCommandController creates a controller running the configured commands
+func newCommandController(cfg config.LifecycleConfig) *commandController {
+	return &commandController{
+		stopCommand:   cfg.StopCommand,
+		startCommand:  cfg.StartCommand,
+		statusCommand: cfg.StatusCommand,
+	}
+}
+
+// Running runs the status command, a non-zero exit means the node is stopped
+func (c *commandController) Running(ctx context.Context) (bool, error) {
+	err := runCommand(ctx, c.statusCommand)
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitErr) && ctx.Err() == nil:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Stop runs the stop command and waits until the status command reports the node stopped
+func (c *commandController) Stop(ctx context.Context) error {
+	if err := runCommand(ctx, c.stopCommand); err != nil {
+		return err
+	}
+	return waitFor(ctx, c, false)
+}
+
+// Start runs the start command and waits until the status command reports the node running
+func (c *commandController) Start(ctx context.Context) error {
+	if running, err := c.Running(ctx); err != nil || running {
+		return err
+	}
+
+	if err := runCommand(ctx, c.startCommand); err != nil {
+		return err
+	}
+
+	return waitFor(ctx, c, true)
+}
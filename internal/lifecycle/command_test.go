@@ -0,0 +1,90 @@
+package lifecycle
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"go.uber.org/zap"
+)
+
+func TestCommandController(t *testing.T) {
+	dir := t.TempDir()
+	running := filepath.Join(dir, "running")
+	starts := filepath.Join(dir, "starts")
+	controller, err := New(nodeConfig(config.LifecycleConfig{
+		Type:          config.LifecycleCommand,
+		StopCommand:   "rm " + running,
+		StartCommand:  "echo start >> " + starts + "; touch " + running,
+		StatusCommand: "test -f " + running,
+	}), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if running, err := controller.Running(ctx); err != nil || running {
+		t.Fatalf("Running = %v, %v before start", running, err)
+	}
+
+	if err := controller.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if running, err := controller.Running(ctx); err != nil || !running {
+		t.Fatalf("Running = %v, %v after start", running, err)
+	}
+
+	// Starting a running node leaves it alone
+	if err := controller.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(starts); strings.Count(string(data), "start") != 1 {
+		t.Errorf("start command ran %d times", strings.Count(string(data), "start"))
+	}
+
+	if err := controller.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if running, err := controller.Running(ctx); err != nil || running {
+		t.Fatalf("Running = %v, %v after stop", running, err)
+	}
+}
+
+func TestCommandControllerFailures(t *testing.T) {
+	dir := t.TempDir()
+	running := filepath.Join(dir, "running")
+	if err := os.WriteFile(running, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stop command that doesn't stop the node times out
+	controller, err := New(nodeConfig(config.LifecycleConfig{
+		Type:          config.LifecycleCommand,
+		StopCommand:   "true",
+		StartCommand:  "echo boom; exit 3",
+		StatusCommand: "test -f " + running,
+	}), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := controller.Stop(ctx); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Errorf("Stop = %v, want still running", err)
+	}
+
+	// A failing start command reports its output
+	if err := os.Remove(running); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Start = %v, want the command output", err)
+	}
+}
@@ -0,0 +1,164 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"go.uber.org/zap"
+)
+
+// Lifecycle defaults
+const (
+	defaultStopTimeout  = 2 * time.Minute
+	defaultStartTimeout = 2 * time.Minute
+
+	// pollInterval is how often the node state is checked while it stops or starts
+	pollInterval = 500 * time.Millisecond
+)
+
+// Controller stops and starts a blockchain node so its data directory can be
+// archived while nothing writes to it
+type Controller interface {
+	// Running reports whether the node process is running
+	Running(ctx context.Context) (bool, error)
+	// Stop stops the node and returns once it has exited
+	Stop(ctx context.Context) error
+	// Start starts the node unless it is running and returns once it runs
+	Start(ctx context.Context) error
+}
+
+// New creates the lifecycle controller configured for a node, or nil when the
+// node is archived while it runs
+func New(cfg *config.NodeConfig, logger *zap.Logger) (Controller, error) {
+	lc := cfg.Node.Lifecycle
+	switch lc.Type {
+	case "", config.LifecycleNone:
+		return nil, nil
+	case config.LifecyclePID:
+		return newPIDController(lc, logger)
+	case config.LifecycleCommand:
+		return newCommandController(lc), nil
+	default:
+		return nil, fmt.Errorf("unsupported node lifecycle type: %s", lc.Type)
+	}
+}
+
+// WhileStopped stops the node, runs fn and starts the node again. beforeStop, if
+// set, runs right before the node is stopped and keeps it running when it fails.
+// The node is started again whatever happens to fn: failures, cancellation of ctx
+// and max_downtime all end in a restart. A node that isn't running is left
+// stopped and beforeStop is skipped.
+func WhileStopped(ctx context.Context, c Controller, cfg config.LifecycleConfig, logger *zap.Logger, beforeStop, fn func(ctx context.Context) error) (err error) {
+	running, err := c.Running(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check node status: %w", err)
+	}
+	if !running {
+		logger.Info("Node is not running, archiving without stopping it")
+		return fn(ctx)
+	}
+
+	if beforeStop != nil {
+		if err := beforeStop(ctx); err != nil {
+			return err
+		}
+	}
+
+	stopTimeout := cfg.StopTimeout
+	if stopTimeout == 0 {
+		stopTimeout = defaultStopTimeout
+	}
+	startTimeout := cfg.StartTimeout
+	if startTimeout == 0 {
+		startTimeout = defaultStartTimeout
+	}
+
+	// Restart the node on every way out, including a cancelled run
+	stopping := time.Now()
+	defer func() {
+		startCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), startTimeout)
+		defer cancel()
+
+		logger.Info("Starting node")
+		if startErr := c.Start(startCtx); startErr != nil {
+			logger.Error("Failed to start node", zap.Error(startErr))
+			err = errors.Join(err, fmt.Errorf("failed to start node: %w", startErr))
+			return
+		}
+		logger.Info("Node started", zap.Duration("downtime", time.Since(stopping)))
+	}()
+
+	logger.Info("Stopping node", zap.Duration("timeout", stopTimeout))
+	stopCtx, cancel := context.WithTimeout(ctx, stopTimeout)
+	err = c.Stop(stopCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to stop node: %w", err)
+	}
+	logger.Info("Node stopped", zap.Duration("took", time.Since(stopping)))
+
+	// Bound how long the node stays down
+	if cfg.MaxDowntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.MaxDowntime)
+		defer cancel()
+	}
+
+	return fn(ctx)
+}
+
+// waitFor polls the node until it is running, or not running, as wanted
+func waitFor(ctx context.Context, c Controller, want bool) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		running, err := c.Running(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			return err
+		case err == nil && running == want:
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if want {
+				return fmt.Errorf("node is not running yet: %w", ctx.Err())
+			}
+			return fmt.Errorf("node is still running: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// runCommand runs a shell command to completion. Its output goes to a file
+// rather than a pipe, so a node it starts in the background doesn't hold it open.
+func runCommand(ctx context.Context, command string) error {
+	output, err := os.CreateTemp("", "snapshot-cosmos-command-*")
+	if err != nil {
+		return fmt.Errorf("failed to create command output file: %w", err)
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if err := cmd.Run(); err != nil {
+		data, _ := os.ReadFile(output.Name())
+		if out := strings.TrimSpace(string(data)); out != "" {
+			return fmt.Errorf("failed to run %q: %w: %s", command, err, out)
+		}
+		return fmt.Errorf("failed to run %q: %w", command, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"go.uber.org/zap"
+)
+
+// fakeController is a node that records the calls it receives
+type fakeController struct {
+	mu       sync.Mutex
+	running  bool
+	calls    []string
+	stopHang bool
+	startErr error
+}
+
+func (c *fakeController) Running(ctx context.Context) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running, nil
+}
+
+func (c *fakeController) Stop(ctx context.Context) error {
+	c.record("stop")
+	if c.stopHang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = false
+	return nil
+}
+
+func (c *fakeController) Start(ctx context.Context) error {
+	c.record("start")
+	if c.startErr != nil {
+		return c.startErr
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = true
+	return nil
+}
+
+func (c *fakeController) record(call string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+func TestWhileStopped(t *testing.T) {
+	errArchive := errors.New("archive failed")
+
+	tests := []struct {
+		name       string
+		controller *fakeController
+		cfg        config.LifecycleConfig
+		cancel     bool
+		beforeStop error
+		fn         func(ctx context.Context) error
+		wantErr    string
+		wantCalls  string
+		wantFn     bool
+	}{
+		{
+			name:       "stops and starts around fn",
+			controller: &fakeController{running: true},
+			fn:         func(ctx context.Context) error { return nil },
+			wantCalls:  "before,stop,fn,start",
+			wantFn:     true,
+		},
+		{
+			name:       "restarts when fn fails",
+			controller: &fakeController{running: true},
+			fn:         func(ctx context.Context) error { return errArchive },
+			wantErr:    "archive failed",
+			wantCalls:  "before,stop,fn,start",
+			wantFn:     true,
+		},
+		{
+			name:       "restarts when ctx is cancelled",
+			controller: &fakeController{running: true},
+			cancel:     true,
+			fn: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			wantErr:   "context canceled",
+			wantCalls: "before,stop,fn,start",
+			wantFn:    true,
+		},
+		{
+			name:       "max_downtime ends fn and restarts",
+			controller: &fakeController{running: true},
+			cfg:        config.LifecycleConfig{MaxDowntime: 20 * time.Millisecond},
+			fn: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			wantErr:   "deadline exceeded",
+			wantCalls: "before,stop,fn,start",
+			wantFn:    true,
+		},
+		{
+			name:       "stop timeout skips fn and restarts",
+			controller: &fakeController{running: true, stopHang: true},
+			cfg:        config.LifecycleConfig{StopTimeout: 20 * time.Millisecond},
+			fn:         func(ctx context.Context) error { return nil },
+			wantErr:    "failed to stop node",
+			wantCalls:  "before,stop,start",
+		},
+		{
+			name:       "node that is not running stays stopped",
+			controller: &fakeController{},
+			fn:         func(ctx context.Context) error { return nil },
+			wantCalls:  "fn",
+			wantFn:     true,
+		},
+		{
+			name:       "failing beforeStop keeps the node running",
+			controller: &fakeController{running: true},
+			beforeStop: errors.New("status failed"),
+			fn:         func(ctx context.Context) error { return nil },
+			wantErr:    "status failed",
+			wantCalls:  "before",
+		},
+		{
+			name:       "start failure is reported",
+			controller: &fakeController{running: true, startErr: errors.New("no start")},
+			fn:         func(ctx context.Context) error { return nil },
+			wantErr:    "failed to start node: no start",
+			wantCalls:  "before,stop,fn,start",
+			wantFn:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var ranFn bool
+			beforeStop := func(ctx context.Context) error {
+				tt.controller.record("before")
+				return tt.beforeStop
+			}
+			fn := func(ctx context.Context) error {
+				ranFn = true
+				tt.controller.record("fn")
+				if running, _ := tt.controller.Running(ctx); running {
+					t.Error("fn ran while the node was running")
+				}
+				if tt.cancel {
+					cancel()
+				}
+				return tt.fn(ctx)
+			}
+
+			err := WhileStopped(ctx, tt.controller, tt.cfg, zap.NewNop(), beforeStop, fn)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+
+			if got := strings.Join(tt.controller.calls, ","); got != tt.wantCalls {
+				t.Errorf("calls = %s, want %s", got, tt.wantCalls)
+			}
+			if ranFn != tt.wantFn {
+				t.Errorf("fn ran = %v, want %v", ranFn, tt.wantFn)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"go.uber.org/zap"
+)
+
+// nodeConfig returns a node configuration with the given lifecycle settings
+func nodeConfig(lc config.LifecycleConfig) *config.NodeConfig {
+	cfg := &config.NodeConfig{}
+	cfg.Node.Lifecycle = lc
+	return cfg
+}
+
+func TestPIDController(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "node.pid")
+	controller, err := New(nodeConfig(config.LifecycleConfig{
+		Type:         config.LifecyclePID,
+		PIDFile:      pidFile,
+		StartCommand: fmt.Sprintf("sleep 60 & echo $! > %s", pidFile),
+	}), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if data, err := os.ReadFile(pidFile); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Without a pid file the node is not running
+	if running, err := controller.Running(ctx); err != nil || running {
+		t.Fatalf("Running = %v, %v before start", running, err)
+	}
+
+	if err := controller.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if running, err := controller.Running(ctx); err != nil || !running {
+		t.Fatalf("Running = %v, %v after start", running, err)
+	}
+	pid, _ := os.ReadFile(pidFile)
+
+	// Starting a running node leaves it alone
+	if err := controller.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(pidFile); string(again) != string(pid) {
+		t.Error("started a node that was running")
+	}
+
+	if err := controller.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if running, err := controller.Running(ctx); err != nil || running {
+		t.Fatalf("Running = %v, %v after stop", running, err)
+	}
+
+	// A garbled pid file is an error
+	if err := os.WriteFile(pidFile, []byte("nope"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := controller.Running(ctx); err == nil {
+		t.Error("accepted an invalid pid file")
+	}
+}
+
+func TestPIDControllerStopTimeout(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "node.pid")
+
+	// The node ignores the stop signal
+	controller, err := New(nodeConfig(config.LifecycleConfig{
+		Type:         config.LifecyclePID,
+		PIDFile:      pidFile,
+		Signal:       "SIGHUP",
+		StartCommand: fmt.Sprintf("(trap '' HUP; sleep 60) & echo $! > %s", pidFile),
+	}), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if data, err := os.ReadFile(pidFile); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	})
+
+	if err := controller.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := controller.Stop(ctx); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Fatalf("Stop = %v, want still running", err)
+	}
+}
+
+func TestNewRejectsUnknownSignal(t *testing.T) {
+	_, err := New(nodeConfig(config.LifecycleConfig{
+		Type:   config.LifecyclePID,
+		Signal: "SIGKILL",
+	}), zap.NewNop())
+	if err == nil {
+		t.Error("accepted SIGKILL")
+	}
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "snapshot_cosmos"
+
+// Phases of a snapshot run
+const (
+	PhaseArchive = "archive"
+	PhaseUpload  = "upload"
+	PhaseCleanup = "cleanup"
+)
+
+// TargetSnapshotDir labels retention deletions in the local snapshot directory,
+// other targets are named after their destination
+const TargetSnapshotDir = "snapshot_dir"
+
+// Results of a snapshot run
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultSkipped = "skipped"
+)
+
+var (
+	lastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful snapshot run.",
+	}, []string{"node"})
+
+	lastAttempt = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_attempt_timestamp_seconds",
+		Help:      "Unix time the last snapshot run finished.",
+	}, []string{"node"})
+
+	lastAttemptSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_attempt_success",
+		Help:      "Whether the last snapshot run succeeded (1) or failed (0).",
+	}, []string{"node"})
+
+	runs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "runs_total",
+		Help:      "Snapshot runs by result: success, failure or skipped for an unhealthy node.",
+	}, []string{"node", "result"})
+
+	phaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "phase_duration_seconds",
+		Help:      "Duration of the archive, upload and cleanup phases of a snapshot run.",
+		// 1s up to about 18h
+		Buckets: prometheus.ExponentialBuckets(1, 2, 17),
+	}, []string{"node", "phase"})
+
+	archiveBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "archive_size_bytes",
+		Help:      "Size of the last snapshot archive.",
+	}, []string{"node"})
+
+	snapshotHeight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "snapshot_height",
+		Help:      "Block height of the last snapshot.",
+	}, []string{"node"})
+
+	remoteObjects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "remote_objects",
+		Help:      "Snapshot archives stored at a destination.",
+	}, []string{"node", "destination"})
+
+	remoteBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "remote_size_bytes",
+		Help:      "Total size of the snapshot archives stored at a destination.",
+	}, []string{"node", "destination"})
+
+	retentionDeletions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_deletions_total",
+		Help:      "Snapshot archives deleted by retention, by target.",
+	}, []string{"node", "target"})
+
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Errors by snapshot run phase.",
+	}, []string{"node", "phase"})
+)
+
+// Handler returns the HTTP handler that serves the metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Node records the metrics of a single node
+type Node struct {
+	name string
+}
+
+// ForNode returns the metrics recorder of the named node
+func ForNode(name string) *Node {
+	return &Node{name: name}
+}
+
+// RunFinished records the outcome of a snapshot run
+func (n *Node) RunFinished(err error) {
+	now := float64(time.Now().Unix())
+	lastAttempt.WithLabelValues(n.name).Set(now)
+
+	if err != nil {
+		lastAttemptSuccess.WithLabelValues(n.name).Set(0)
+		runs.WithLabelValues(n.name, ResultFailure).Inc()
+		return
+	}
+
+	lastSuccess.WithLabelValues(n.name).Set(now)
+	lastAttemptSuccess.WithLabelValues(n.name).Set(1)
+	runs.WithLabelValues(n.name, ResultSuccess).Inc()
+}
+
+// RunSkipped records a run skipped because the node was unhealthy
+func (n *Node) RunSkipped() {
+	lastAttempt.WithLabelValues(n.name).Set(float64(time.Now().Unix()))
+	lastAttemptSuccess.WithLabelValues(n.name).Set(0)
+	runs.WithLabelValues(n.name, ResultSkipped).Inc()
+}
+
+// LastSuccess records a successful run of an earlier process
+func (n *Node) LastSuccess(t time.Time) {
+	lastSuccess.WithLabelValues(n.name).Set(float64(t.Unix()))
+}
+
+// ObservePhase records how long a phase took
+func (n *Node) ObservePhase(phase string, d time.Duration) {
+	phaseDuration.WithLabelValues(n.name, phase).Observe(d.Seconds())
+}
+
+// Error counts an error in a phase
+func (n *Node) Error(phase string) {
+	errorsTotal.WithLabelValues(n.name, phase).Inc()
+}
+
+// Archive records the size and block height of a new snapshot archive
+func (n *Node) Archive(size, height int64) {
+	archiveBytes.WithLabelValues(n.name).Set(float64(size))
+	snapshotHeight.WithLabelValues(n.name).Set(float64(height))
+}
+
+// Stored records the archives kept at a destination
+func (n *Node) Stored(destination string, objects int, size int64) {
+	remoteObjects.WithLabelValues(n.name, destination).Set(float64(objects))
+	remoteBytes.WithLabelValues(n.name, destination).Set(float64(size))
+}
+
+// Deleted counts archives removed by retention from a target
+func (n *Node) Deleted(target string, count int) {
+	retentionDeletions.WithLabelValues(n.name, target).Add(float64(count))
+}
@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// resetMetrics drops the series recorded by earlier tests
+func resetMetrics() {
+	for _, vec := range []interface{ Reset() }{
+		lastSuccess, lastAttempt, lastAttemptSuccess, runs, phaseDuration, archiveBytes,
+		snapshotHeight, remoteObjects, remoteBytes, retentionDeletions, errorsTotal,
+	} {
+		vec.Reset()
+	}
+}
+
+// recordRuns records a successful, a failed and a skipped run of node
+func recordRuns(node string) {
+	n := ForNode(node)
+	n.Archive(1024, 100)
+	n.ObservePhase(PhaseArchive, 3*time.Second)
+	n.ObservePhase(PhaseUpload, 90*time.Second)
+	n.Stored("s3", 2, 2048)
+	n.Deleted("s3", 1)
+	n.Deleted(TargetSnapshotDir, 0)
+	n.RunFinished(nil)
+
+	n.Error(PhaseUpload)
+	n.RunFinished(errors.New("upload failed"))
+
+	n.RunSkipped()
+}
+
+func TestNodeMetrics(t *testing.T) {
+	resetMetrics()
+	before := float64(time.Now().Unix())
+	recordRuns("node-1")
+	after := float64(time.Now().Unix())
+
+	tests := []struct {
+		collector prometheus.Collector
+		want      string
+	}{
+		{runs, `
+# HELP snapshot_cosmos_runs_total Snapshot runs by result: success, failure or skipped for an unhealthy node.
+# TYPE snapshot_cosmos_runs_total counter
+snapshot_cosmos_runs_total{node="node-1",result="failure"} 1
+snapshot_cosmos_runs_total{node="node-1",result="skipped"} 1
+snapshot_cosmos_runs_total{node="node-1",result="success"} 1
+`},
+		{lastAttemptSuccess, `
+# HELP snapshot_cosmos_last_attempt_success Whether the last snapshot run succeeded (1) or failed (0).
+# TYPE snapshot_cosmos_last_attempt_success gauge
+snapshot_cosmos_last_attempt_success{node="node-1"} 0
+`},
+		{archiveBytes, `
+# HELP snapshot_cosmos_archive_size_bytes Size of the last snapshot archive.
+# TYPE snapshot_cosmos_archive_size_bytes gauge
+snapshot_cosmos_archive_size_bytes{node="node-1"} 1024
+`},
+		{snapshotHeight, `
+# HELP snapshot_cosmos_snapshot_height Block height of the last snapshot.
+# TYPE snapshot_cosmos_snapshot_height gauge
+snapshot_cosmos_snapshot_height{node="node-1"} 100
+`},
+		{remoteObjects, `
+# HELP snapshot_cosmos_remote_objects Snapshot archives stored at a destination.
+# TYPE snapshot_cosmos_remote_objects gauge
+snapshot_cosmos_remote_objects{destination="s3",node="node-1"} 2
+`},
+		{remoteBytes, `
+# HELP snapshot_cosmos_remote_size_bytes Total size of the snapshot archives stored at a destination.
+# TYPE snapshot_cosmos_remote_size_bytes gauge
+snapshot_cosmos_remote_size_bytes{destination="s3",node="node-1"} 2048
+`},
+		{retentionDeletions, `
+# HELP snapshot_cosmos_retention_deletions_total Snapshot archives deleted by retention, by target.
+# TYPE snapshot_cosmos_retention_deletions_total counter
+snapshot_cosmos_retention_deletions_total{node="node-1",target="s3"} 1
+snapshot_cosmos_retention_deletions_total{node="node-1",target="snapshot_dir"} 0
+`},
+		{errorsTotal, `
+# HELP snapshot_cosmos_errors_total Errors by snapshot run phase.
+# TYPE snapshot_cosmos_errors_total counter
+snapshot_cosmos_errors_total{node="node-1",phase="upload"} 1
+`},
+	}
+
+	for _, tt := range tests {
+		if err := testutil.CollectAndCompare(tt.collector, strings.NewReader(tt.want)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The timestamps are those of the last attempt and the last success
+	for name, gauge := range map[string]prometheus.Collector{
+		"last_success": lastSuccess.WithLabelValues("node-1"),
+		"last_attempt": lastAttempt.WithLabelValues("node-1"),
+	} {
+		if got := testutil.ToFloat64(gauge); got < before || got > after {
+			t.Errorf("%s = %v, want between %v and %v", name, got, before, after)
+		}
+	}
+
+	// A phase is observed once per run in its own series
+	if got := testutil.CollectAndCount(phaseDuration); got != 2 {
+		t.Errorf("phase duration series = %d, want 2", got)
+	}
+	archive := phaseDuration.WithLabelValues("node-1", PhaseArchive).(prometheus.Histogram)
+	if got := testutil.CollectAndCount(archive); got != 1 {
+		t.Errorf("archive phase series = %d, want 1", got)
+	}
+
+	// A success of an earlier process sets the timestamp without counting a run
+	restored := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	ForNode("node-2").LastSuccess(restored)
+	if got := testutil.ToFloat64(lastSuccess.WithLabelValues("node-2")); got != float64(restored.Unix()) {
+		t.Errorf("restored last success = %v, want %v", got, restored.Unix())
+	}
+	if got := testutil.ToFloat64(runs.WithLabelValues("node-2", ResultSuccess)); got != 0 {
+		t.Errorf("restored success counted %v runs", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	resetMetrics()
+	recordRuns("node-3")
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, series := range []string{
+		`snapshot_cosmos_last_success_timestamp_seconds{node="node-3"}`,
+		`snapshot_cosmos_last_attempt_timestamp_seconds{node="node-3"}`,
+		`snapshot_cosmos_last_attempt_success{node="node-3"} 0`,
+		`snapshot_cosmos_runs_total{node="node-3",result="success"} 1`,
+		`snapshot_cosmos_phase_duration_seconds_count{node="node-3",phase="archive"} 1`,
+		`snapshot_cosmos_phase_duration_seconds_bucket{node="node-3",phase="upload",le="128"} 1`,
+		`snapshot_cosmos_archive_size_bytes{node="node-3"} 1024`,
+		`snapshot_cosmos_snapshot_height{node="node-3"} 100`,
+		`snapshot_cosmos_remote_objects{destination="s3",node="node-3"} 2`,
+		`snapshot_cosmos_remote_size_bytes{destination="s3",node="node-3"} 2048`,
+		`snapshot_cosmos_retention_deletions_total{node="node-3",target="s3"} 1`,
+		`snapshot_cosmos_errors_total{node="node-3",phase="upload"} 1`,
+		// Process and Go runtime metrics of the default registry
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), series) {
+			t.Errorf("scrape is missing %s", series)
+		}
+	}
+
+	problems, err := testutil.GatherAndLint(prometheus.DefaultGatherer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range problems {
+		if strings.HasPrefix(problem.Metric, namespace) {
+			t.Errorf("metric %s: %s", problem.Metric, problem.Text)
+		}
+	}
+}
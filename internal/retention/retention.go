@@ -0,0 +1,119 @@
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+)
+
+// Item is a snapshot archive retention decides about
+type Item struct {
+	Key    string
+	Time   time.Time
+	Height int64
+	Size   int64
+}
+
+// Decision is the retention outcome for a single archive
+type Decision struct {
+	Item
+	Keep   bool
+	Reason string
+}
+
+// bucket groups snapshots into calendar periods for the grandfather-father-son rules
+type bucket struct {
+	name   string
+	count  int
+	period func(t time.Time) string
+}
+
+// Plan decides which archives a policy keeps. The newest archive is always kept.
+// Decisions are returned newest first.
+func Plan(policy config.RetentionPolicy, items []Item, now time.Time) []Decision {
+	decisions := make([]Decision, len(items))
+	for i, item := range items {
+		decisions[i] = Decision{Item: item}
+	}
+
+	// Newest first, snapshots taken within the same second are ordered by height
+	sort.SliceStable(decisions, func(i, j int) bool {
+		if !decisions[i].Time.Equal(decisions[j].Time) {
+			return decisions[i].Time.After(decisions[j].Time)
+		}
+		return decisions[i].Height > decisions[j].Height
+	})
+
+	reasons := make([][]string, len(decisions))
+
+	// Keep the most recent snapshots
+	for i := 0; i < len(decisions) && i < policy.KeepLast; i++ {
+		reasons[i] = append(reasons[i], fmt.Sprintf("last %d", policy.KeepLast))
+	}
+
+	// Keep the newest snapshot of each of the most recent periods
+	buckets := []bucket{
+		{"hourly", policy.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15h") }},
+		{"daily", policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, b := range buckets {
+		seen := map[string]bool{}
+		for i, decision := range decisions {
+			if len(seen) >= b.count {
+				break
+			}
+			period := b.period(decision.Time)
+			if seen[period] {
+				continue
+			}
+			seen[period] = true
+			reasons[i] = append(reasons[i], fmt.Sprintf("%s %s", b.name, period))
+		}
+	}
+
+	// Never delete snapshots younger than the minimum age
+	protected := make([]bool, len(decisions))
+	for i, decision := range decisions {
+		if policy.MinAge > 0 && now.Sub(decision.Time) < policy.MinAge {
+			protected[i] = true
+			reasons[i] = append(reasons[i], fmt.Sprintf("younger than min_age %s", policy.MinAge))
+		}
+	}
+
+	// Always keep the newest snapshot, it may have been uploaded moments ago
+	if len(decisions) > 0 && len(reasons[0]) == 0 {
+		reasons[0] = append(reasons[0], "newest")
+	}
+
+	var total int64
+	for i := range decisions {
+		decisions[i].Keep = len(reasons[i]) > 0
+		if decisions[i].Keep {
+			decisions[i].Reason = strings.Join(reasons[i], ", ")
+			total += decisions[i].Size
+		} else {
+			decisions[i].Reason = "not selected by any rule"
+		}
+	}
+
+	// Drop the oldest kept snapshots until the total size fits, sparing the newest
+	maxTotal := policy.MaxTotalSizeMB * 1024 * 1024
+	for i := len(decisions) - 1; i > 0 && maxTotal > 0 && total > maxTotal; i-- {
+		if !decisions[i].Keep || protected[i] {
+			continue
+		}
+		decisions[i].Keep = false
+		decisions[i].Reason = fmt.Sprintf("exceeds max_total_size_mb %d", policy.MaxTotalSizeMB)
+		total -= decisions[i].Size
+	}
+
+	return decisions
+}
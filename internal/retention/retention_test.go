@@ -0,0 +1,157 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+)
+
+// at parses a UTC timestamp
+func at(t *testing.T, value string) time.Time {
+	t.Helper()
+
+	parsed, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestPlan(t *testing.T) {
+	const mb = 1024 * 1024
+
+	tests := []struct {
+		name   string
+		policy config.RetentionPolicy
+		items  map[string]string // key -> time
+		sizes  map[string]int64
+		now    string
+		keep   []string
+	}{
+		{
+			name:   "keep last",
+			policy: config.RetentionPolicy{KeepLast: 2},
+			items:  map[string]string{"a": "2024-01-01 00:00", "b": "2024-01-02 00:00", "c": "2024-01-03 00:00"},
+			now:    "2024-01-04 00:00",
+			keep:   []string{"b", "c"},
+		},
+		{
+			name:   "daily keeps the newest of each day",
+			policy: config.RetentionPolicy{Daily: 2},
+			items:  map[string]string{"a": "2024-01-01 06:00", "b": "2024-01-01 18:00", "c": "2024-01-02 06:00", "d": "2024-01-02 18:00"},
+			now:    "2024-01-03 00:00",
+			keep:   []string{"b", "d"},
+		},
+		{
+			name:   "hourly",
+			policy: config.RetentionPolicy{Hourly: 2},
+			items:  map[string]string{"a": "2024-01-01 10:10", "b": "2024-01-01 10:50", "c": "2024-01-01 11:10", "d": "2024-01-01 12:10"},
+			now:    "2024-01-01 13:00",
+			keep:   []string{"c", "d"},
+		},
+		{
+			name:   "weekly uses ISO weeks across the year boundary",
+			policy: config.RetentionPolicy{Weekly: 2},
+			// 2020-12-31 and 2021-01-03 are both in 2020-W53, 2021-01-04 starts 2021-W01
+			items: map[string]string{"a": "2020-12-27 12:00", "b": "2020-12-31 12:00", "c": "2021-01-03 12:00", "d": "2021-01-04 12:00"},
+			now:   "2021-01-05 00:00",
+			keep:  []string{"c", "d"},
+		},
+		{
+			name:   "monthly",
+			policy: config.RetentionPolicy{Monthly: 2},
+			items:  map[string]string{"a": "2024-01-10 00:00", "b": "2024-01-20 00:00", "c": "2024-02-10 00:00", "d": "2024-03-10 00:00"},
+			now:    "2024-03-11 00:00",
+			keep:   []string{"c", "d"},
+		},
+		{
+			name:   "min_age protects young snapshots",
+			policy: config.RetentionPolicy{KeepLast: 1, MinAge: 48 * time.Hour},
+			items:  map[string]string{"a": "2024-01-01 00:00", "b": "2024-01-09 00:00", "c": "2024-01-10 00:00"},
+			now:    "2024-01-10 12:00",
+			keep:   []string{"b", "c"},
+		},
+		{
+			name:   "size cap drops the oldest kept snapshots",
+			policy: config.RetentionPolicy{KeepLast: 3, MaxTotalSizeMB: 2},
+			items:  map[string]string{"a": "2024-01-01 00:00", "b": "2024-01-02 00:00", "c": "2024-01-03 00:00"},
+			sizes:  map[string]int64{"a": mb, "b": mb, "c": mb},
+			now:    "2024-01-04 00:00",
+			keep:   []string{"b", "c"},
+		},
+		{
+			name:   "size cap spares min_age",
+			policy: config.RetentionPolicy{KeepLast: 3, MaxTotalSizeMB: 1, MinAge: 36 * time.Hour},
+			items:  map[string]string{"a": "2024-01-01 00:00", "b": "2024-01-02 00:00", "c": "2024-01-03 00:00"},
+			sizes:  map[string]int64{"a": mb, "b": mb, "c": mb},
+			now:    "2024-01-03 06:00",
+			keep:   []string{"b", "c"},
+		},
+		{
+			name:   "size cap never drops the newest",
+			policy: config.RetentionPolicy{KeepLast: 2, MaxTotalSizeMB: 1},
+			items:  map[string]string{"a": "2024-01-01 00:00", "b": "2024-01-02 00:00"},
+			sizes:  map[string]int64{"a": 2 * mb, "b": 2 * mb},
+			now:    "2024-01-03 00:00",
+			keep:   []string{"b"},
+		},
+		{
+			name:   "newest kept without a selecting rule",
+			policy: config.RetentionPolicy{MaxTotalSizeMB: 10},
+			items:  map[string]string{"a": "2024-01-01 00:00", "b": "2024-01-02 00:00"},
+			now:    "2024-01-03 00:00",
+			keep:   []string{"b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var items []Item
+			for key, value := range tt.items {
+				items = append(items, Item{Key: key, Time: at(t, value), Size: tt.sizes[key]})
+			}
+
+			kept := map[string]bool{}
+			for _, decision := range Plan(tt.policy, items, at(t, tt.now)) {
+				if decision.Keep {
+					kept[decision.Key] = true
+				}
+				if decision.Reason == "" {
+					t.Errorf("%s has no reason", decision.Key)
+				}
+			}
+
+			if len(kept) != len(tt.keep) {
+				t.Fatalf("kept %v, want %v", kept, tt.keep)
+			}
+			for _, key := range tt.keep {
+				if !kept[key] {
+					t.Fatalf("kept %v, want %v", kept, tt.keep)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanOrder(t *testing.T) {
+	same := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	items := []Item{
+		{Key: "low", Time: same, Height: 100},
+		{Key: "old", Time: same.Add(-time.Hour), Height: 300},
+		{Key: "high", Time: same, Height: 200},
+	}
+
+	decisions := Plan(config.RetentionPolicy{KeepLast: 1}, items, same)
+
+	var order []string
+	for _, decision := range decisions {
+		order = append(order, decision.Key)
+	}
+	if order[0] != "high" || order[1] != "low" || order[2] != "old" {
+		t.Fatalf("order = %v, want newest first and higher heights first within a second", order)
+	}
+	if !decisions[0].Keep || decisions[1].Keep || decisions[2].Keep {
+		t.Fatalf("decisions = %+v", decisions)
+	}
+}
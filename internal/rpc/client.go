@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Status holds the subset of the CometBFT /status response we care about
+type Status struct {
+	NodeInfo struct {
+		Network string `json:"network"`
+		Version string `json:"version"`
+		Moniker string `json:"moniker"`
+	} `json:"node_info"`
+	SyncInfo struct {
+		LatestBlockHash   string    `json:"latest_block_hash"`
+		LatestAppHash     string    `json:"latest_app_hash"`
+		LatestBlockHeight int64     `json:"latest_block_height,string"`
+		LatestBlockTime   time.Time `json:"latest_block_time"`
+		CatchingUp        bool      `json:"catching_up"`
+	} `json:"sync_info"`
+}
+
+// Client talks to a CometBFT RPC endpoint
+type Client struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+// NewClient creates a new RPC client for the given endpoint
+func NewClient(endpoint string, timeout time.Duration) *Client {
+	return &Client{
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Status queries the node /status endpoint
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"/status", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query node status: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from %s: %d", c.endpoint, resp.StatusCode)
+	}
+
+	var body struct {
+		Result *Status `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Data    string `json:"data"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode status response: %w", err)
+	}
+
+	if body.Error != nil {
+		return nil, fmt.Errorf("node returned error %d: %s %s", body.Error.Code, body.Error.Message, body.Error.Data)
+	}
+	if body.Result == nil {
+		return nil, fmt.Errorf("empty status response from %s", c.endpoint)
+	}
+
+	return body.Result, nil
+}
@@ -0,0 +1,343 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// PartialSuffix is appended to a local path while its download is in progress
+	PartialSuffix = ".partial"
+	// defaultDownloadConcurrency is the number of ranges fetched in parallel when none is configured
+	defaultDownloadConcurrency = 8
+	// sha256MetadataKey is the object metadata key holding the SHA-256 of the object
+	sha256MetadataKey = "sha256"
+)
+
+// downloadState records which chunks of a download are already on disk
+type downloadState struct {
+	Key       string         `json:"key"`
+	ETag      string         `json:"etag"`
+	Size      int64          `json:"size"`
+	ChunkSize int64          `json:"chunk_size"`
+	Done      map[int64]bool `json:"done"`
+}
+
+// downloadRanges fetches an object in parallel byte ranges into a .partial file,
+// resuming chunks already on disk, verifies it and renames it into place
+func (s *Service) downloadRanges(ctx context.Context, s3Key, localPath string, head *s3.HeadObjectOutput) error {
+	partialPath := localPath + PartialSuffix
+	statePath := partialPath + ".json"
+	size := aws.ToInt64(head.ContentLength)
+	etag := aws.ToString(head.ETag)
+	chunkSize := int64(s.partSize())
+
+	// Resume from a previous attempt of the same object version
+	state := readDownloadState(statePath)
+	if state == nil || state.Key != s3Key || state.ETag != etag || state.Size != size || state.ChunkSize != chunkSize {
+		state = &downloadState{Key: s3Key, ETag: etag, Size: size, ChunkSize: chunkSize, Done: map[int64]bool{}}
+		if err := os.Remove(partialPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale partial file: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open partial file: %w", err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to allocate partial file: %w", err)
+	}
+
+	chunks := (size + chunkSize - 1) / chunkSize
+	pending := make(chan int64, chunks)
+	for chunk := int64(0); chunk < chunks; chunk++ {
+		if !state.Done[chunk] {
+			pending <- chunk
+		}
+	}
+	close(pending)
+
+	s.logger.Info("Downloading object in ranges",
+		zap.String("s3_key", s3Key),
+		zap.Int64("size", size),
+		zap.Int64("chunks", chunks),
+		zap.Int("completed_chunks", len(state.Done)),
+		zap.Int("concurrency", s.downloadConcurrency()))
+
+	rangeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+
+	for i := 0; i < s.downloadConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range pending {
+				start := chunk * chunkSize
+				end := min(start+chunkSize, size) - 1
+
+				err := s.downloadRangeWithRetry(rangeCtx, s3Key, etag, file, start, end)
+
+				mu.Lock()
+				if err == nil {
+					state.Done[chunk] = true
+					err = writeDownloadState(statePath, state)
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		s.logger.Error("Download interrupted, rerun the download to resume",
+			zap.String("s3_key", s3Key),
+			zap.Int("completed_chunks", len(state.Done)),
+			zap.String("partial_file", partialPath))
+		return firstErr
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync partial file: %w", err)
+	}
+
+	// Verify before the file gets its final name, a corrupt download can't be resumed
+	if err := s.verifyDownload(ctx, file, s3Key, head); err != nil {
+		file.Close()
+		os.Remove(partialPath)
+		os.Remove(statePath)
+		return fmt.Errorf("downloaded file failed verification: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close partial file: %w", err)
+	}
+
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return fmt.Errorf("failed to move download into place: %w", err)
+	}
+
+	os.Remove(statePath)
+	return nil
+}
+
+// downloadRangeWithRetry downloads a single range, retrying with exponential backoff
+func (s *Service) downloadRangeWithRetry(ctx context.Context, s3Key, etag string, file *os.File, start, end int64) error {
+	backoff := partRetryBackoff
+
+	var lastErr error
+	for attempt := 1; attempt <= maxPartAttempts; attempt++ {
+		err := s.downloadRange(ctx, s3Key, etag, file, start, end)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		if ctx.Err() != nil || attempt == maxPartAttempts {
+			break
+		}
+
+		s.logger.Warn("Range download failed, retrying",
+			zap.Int64("start", start),
+			zap.Int64("end", end),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return fmt.Errorf("failed to download bytes %d-%d: %w", start, end, lastErr)
+		}
+	}
+
+	return fmt.Errorf("failed to download bytes %d-%d: %w", start, end, lastErr)
+}
+
+// downloadRange fetches bytes start-end of an object and writes them at the same offset
+func (s *Service) downloadRange(ctx context.Context, s3Key, etag string, file *os.File, start, end int64) error {
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:  aws.String(s.cfg.S3.Bucket),
+		Key:     aws.String(s3Key),
+		Range:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get range: %w", err)
+	}
+	defer result.Body.Close()
+
+	n, err := io.Copy(io.NewOffsetWriter(file, start), result.Body)
+	if err != nil {
+		return fmt.Errorf("failed to write range: %w", err)
+	}
+	if n != end-start+1 {
+		return fmt.Errorf("short range read: got %d of %d bytes", n, end-start+1)
+	}
+
+	return nil
+}
+
+// verifyDownload checks the size of the downloaded file and its checksum. The
+// SHA-256 stored in the object metadata is preferred; otherwise the ETag is
+// recomputed, which only works for objects without KMS encryption.
+func (s *Service) verifyDownload(ctx context.Context, file *os.File, s3Key string, head *s3.HeadObjectOutput) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	if info.Size() != aws.ToInt64(head.ContentLength) {
+		return fmt.Errorf("size %d does not match object size %d", info.Size(), aws.ToInt64(head.ContentLength))
+	}
+
+	if want := head.Metadata[sha256MetadataKey]; want != "" {
+		got, err := fileDigest(file, sha256.New())
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("sha256 %s does not match object sha256 %s", got, want)
+		}
+		s.logger.Info("Verified download checksum", zap.String("s3_key", s3Key), zap.String("sha256", got))
+		return nil
+	}
+
+	if head.ServerSideEncryption == types.ServerSideEncryptionAwsKms || head.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse {
+		s.logger.Warn("Object has no checksum metadata and a KMS ETag, only the size was verified", zap.String("s3_key", s3Key))
+		return nil
+	}
+
+	etag := strings.Trim(aws.ToString(head.ETag), `"`)
+	got, err := s.computeETag(ctx, file, s3Key, etag)
+	if err != nil {
+		return err
+	}
+	if got != etag {
+		return fmt.Errorf("ETag %s does not match object ETag %s", got, etag)
+	}
+
+	s.logger.Info("Verified download ETag", zap.String("s3_key", s3Key), zap.String("etag", etag))
+	return nil
+}
+
+// computeETag computes the S3 ETag of a local file. Multipart ETags are the MD5
+// of the part MD5s, so the part size is taken from the first part of the object.
+func (s *Service) computeETag(ctx context.Context, file *os.File, s3Key, etag string) (string, error) {
+	_, partsStr, multipart := strings.Cut(etag, "-")
+	if !multipart {
+		return fileDigest(file, md5.New())
+	}
+
+	parts, err := strconv.Atoi(partsStr)
+	if err != nil {
+		return "", fmt.Errorf("unexpected ETag format %s", etag)
+	}
+
+	firstPart, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:     aws.String(s.cfg.S3.Bucket),
+		Key:        aws.String(s3Key),
+		PartNumber: aws.Int32(1),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get part size: %w", err)
+	}
+	partSize := aws.ToInt64(firstPart.ContentLength)
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	var digests []byte
+	for offset := int64(0); offset < info.Size(); offset += partSize {
+		partHash := md5.New()
+		if _, err := io.Copy(partHash, io.NewSectionReader(file, offset, partSize)); err != nil {
+			return "", fmt.Errorf("failed to hash file: %w", err)
+		}
+		digests = partHash.Sum(digests)
+	}
+
+	sum := md5.Sum(digests)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts), nil
+}
+
+// fileDigest hashes the whole file with h
+func fileDigest(file *os.File, h hash.Hash) (string, error) {
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, 1<<62)); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readDownloadState loads the state of an interrupted download, if any
+func readDownloadState(statePath string) *downloadState {
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil
+	}
+
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil || state.Done == nil {
+		return nil
+	}
+
+	return &state
+}
+
+// writeDownloadState atomically replaces the download state file
+func writeDownloadState(statePath string, state *downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode download state: %w", err)
+	}
+
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write download state: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, statePath); err != nil {
+		return fmt.Errorf("failed to write download state: %w", err)
+	}
+
+	return nil
+}
+
+// downloadConcurrency returns the configured number of parallel range downloads
+func (s *Service) downloadConcurrency() int {
+	if s.cfg.S3.DownloadConcurrency > 0 {
+		return s.cfg.S3.DownloadConcurrency
+	}
+	return defaultDownloadConcurrency
+}
@@ -0,0 +1,190 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failRanges fails every request for a range starting at one of the offsets
+func failRanges(offsets ...string) func(op string, r *http.Request) int {
+	return func(op string, r *http.Request) int {
+		for _, offset := range offsets {
+			if op == "GetObject" && strings.HasPrefix(r.Header.Get("Range"), "bytes="+offset+"-") {
+				return http.StatusBadRequest
+			}
+		}
+		return 0
+	}
+}
+
+// assertDownloadCleaned fails when a download left files behind in dir
+func assertDownloadCleaned(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("left behind: %s", entry.Name())
+	}
+}
+
+func TestDownload(t *testing.T) {
+	data := testData(5 << 19)
+	sum := sha256.Sum256(data)
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{"verified by multipart ETag", nil},
+		{"verified by sha256", map[string]string{sha256MetadataKey: hex.EncodeToString(sum[:])}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			svc := newTestService(t, fake)
+			fake.put("node/archive.tar", data, 1<<20, tt.metadata)
+
+			localPath := filepath.Join(t.TempDir(), "archive.tar")
+			if err := svc.Download(context.Background(), "node/archive.tar", localPath); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(localPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("downloaded file does not match the object")
+			}
+			if _, err := os.Stat(localPath + PartialSuffix + ".json"); !os.IsNotExist(err) {
+				t.Errorf("download state left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestDownloadResumes(t *testing.T) {
+	fastRetries(t)
+	fake := newFakeS3(t)
+	svc := newTestService(t, fake)
+	svc.cfg.S3.DownloadConcurrency = 1
+	data := testData(5 << 19)
+	fake.put("node/archive.tar", data, 1<<20, nil)
+	localPath := filepath.Join(t.TempDir(), "archive.tar")
+
+	// The last range keeps failing, the first two stay on disk
+	fake.fail = failRanges("2097152")
+	if err := svc.Download(context.Background(), "node/archive.tar", localPath); err == nil {
+		t.Fatal("download succeeded although a range failed")
+	}
+	state := readDownloadState(localPath + PartialSuffix + ".json")
+	if state == nil || len(state.Done) != 2 {
+		t.Fatalf("download state = %+v, want two finished chunks", state)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatal("interrupted download was moved into place")
+	}
+
+	// The rerun only fetches the missing range
+	fake.fail = nil
+	gets := fake.count("GetObject")
+	if err := svc.Download(context.Background(), "node/archive.tar", localPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.count("GetObject") - gets; got != 1 {
+		t.Errorf("resumed download fetched %d ranges, want 1", got)
+	}
+	got, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("resumed file does not match the object")
+	}
+}
+
+func TestDownloadRestartsChangedObject(t *testing.T) {
+	fastRetries(t)
+	fake := newFakeS3(t)
+	svc := newTestService(t, fake)
+	svc.cfg.S3.DownloadConcurrency = 1
+	fake.put("node/archive.tar", testData(5<<19), 1<<20, nil)
+	localPath := filepath.Join(t.TempDir(), "archive.tar")
+
+	fake.fail = failRanges("2097152")
+	if err := svc.Download(context.Background(), "node/archive.tar", localPath); err == nil {
+		t.Fatal("download succeeded although a range failed")
+	}
+
+	// The object was replaced, so the ranges on disk belong to another ETag
+	data := bytes.Repeat([]byte("new"), 1<<20)
+	fake.put("node/archive.tar", data, 1<<20, nil)
+	fake.fail = nil
+	gets := fake.count("GetObject")
+	if err := svc.Download(context.Background(), "node/archive.tar", localPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.count("GetObject") - gets; got != 3 {
+		t.Errorf("restarted download fetched %d ranges, want 3", got)
+	}
+	got, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("restarted file does not match the replaced object")
+	}
+}
+
+func TestDownloadVerificationFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(obj *fakeObject)
+		wantErr string
+	}{
+		{
+			name:    "sha256 mismatch",
+			corrupt: func(obj *fakeObject) { obj.metadata = map[string]string{sha256MetadataKey: strings.Repeat("0", 64)} },
+			wantErr: "sha256",
+		},
+		{
+			name:    "ETag mismatch",
+			corrupt: func(obj *fakeObject) { obj.etag = `"00000000000000000000000000000000-3"` },
+			wantErr: "ETag",
+		},
+		{
+			name:    "single part ETag mismatch",
+			corrupt: func(obj *fakeObject) { obj.etag = `"00000000000000000000000000000000"` },
+			wantErr: "ETag",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			svc := newTestService(t, fake)
+			fake.put("node/archive.tar", testData(5<<19), 1<<20, nil)
+			tt.corrupt(fake.object("node/archive.tar"))
+
+			dir := t.TempDir()
+			err := svc.Download(context.Background(), "node/archive.tar", filepath.Join(dir, "archive.tar"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Download() = %v, want %s mismatch", err, tt.wantErr)
+			}
+
+			// Neither the file nor its partial download survive
+			assertDownloadCleaned(t, dir)
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultPartSizeMB is the multipart part size used when none is configured
+	defaultPartSizeMB = 64
+	// defaultUploadConcurrency is the number of parts uploaded in parallel when none is configured
+	defaultUploadConcurrency = 4
+	// maxParts is the S3 limit on parts per multipart upload
+	maxParts = 10000
+	// abortTimeout bounds aborting a multipart upload after a failure
+	abortTimeout = 30 * time.Second
+)
+
+// StreamWriter uploads everything written to it as a single S3 object using a
+// multipart upload. At most concurrency+1 parts are buffered in memory at a time.
+type StreamWriter struct {
+	svc      *Service
+	client   *s3.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	key      string
+	uploadID string
+
+	partSize int
+	buf      []byte
+	partNum  int32
+	free     chan []byte
+	wg       sync.WaitGroup
+	size     int64
+
+	mu    sync.Mutex
+	parts []types.CompletedPart
+	err   error
+}
+
+// NewWriter starts a multipart upload to s3Key behind the storage.Writer interface
+func (s *Service) NewWriter(ctx context.Context, s3Key, contentType string) (storage.Writer, error) {
+	w, err := s.NewStreamWriter(ctx, s3Key, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// NewStreamWriter starts a multipart upload to s3Key. The object only becomes
+// visible once Close succeeds; CloseWithError aborts the upload, as does
+// cancelling ctx.
+func (s *Service) NewStreamWriter(ctx context.Context, s3Key, contentType string) (*StreamWriter, error) {
+	// Load AWS configuration
+	awsCfg, err := s.loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	// Create S3 client
+	s.client = s3.NewFromConfig(awsCfg, s.clientOptions)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	result, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.cfg.S3.Bucket),
+		Key:         aws.String(s3Key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	partSize := s.partSize()
+	concurrency := s.uploadConcurrency()
+
+	s.logger.Info("Streaming upload to S3",
+		zap.String("s3_key", s3Key),
+		zap.String("bucket", s.cfg.S3.Bucket),
+		zap.String("upload_id", *result.UploadId),
+		zap.Int("part_size", partSize),
+		zap.Int("concurrency", concurrency))
+
+	w := &StreamWriter{
+		svc:      s,
+		client:   s.client,
+		ctx:      ctx,
+		cancel:   cancel,
+		key:      s3Key,
+		uploadID: *result.UploadId,
+		partSize: partSize,
+		free:     make(chan []byte, concurrency+1),
+	}
+	// One buffer is filled while the others are uploading
+	for i := 0; i < concurrency+1; i++ {
+		w.free <- make([]byte, 0, partSize)
+	}
+	w.buf = <-w.free
+
+	return w, nil
+}
+
+// Write buffers p and uploads every full part in the background
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if err := w.failed(); err != nil {
+			return written, err
+		}
+
+		n := copy(w.buf[len(w.buf):w.partSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(w.buf) == w.partSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush uploads the current buffer as the next part and waits for a free buffer
+func (w *StreamWriter) flush() error {
+	if w.partNum >= maxParts {
+		return fmt.Errorf("stream exceeds %d parts of %d bytes, increase s3.part_size_mb", maxParts, w.partSize)
+	}
+
+	w.partNum++
+	w.size += int64(len(w.buf))
+	w.wg.Add(1)
+	go w.uploadPart(w.partNum, w.buf)
+
+	select {
+	case w.buf = <-w.free:
+		return nil
+	case <-w.ctx.Done():
+		return w.failed()
+	}
+}
+
+// uploadPart uploads a single part and returns its buffer to the pool
+func (w *StreamWriter) uploadPart(partNum int32, data []byte) {
+	defer w.wg.Done()
+
+	result, err := w.client.UploadPart(w.ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(w.svc.cfg.S3.Bucket),
+		Key:        aws.String(w.key),
+		UploadId:   aws.String(w.uploadID),
+		PartNumber: aws.Int32(partNum),
+		Body:       bytes.NewReader(data),
+	})
+
+	w.mu.Lock()
+	if err != nil {
+		if w.err == nil {
+			w.err = fmt.Errorf("failed to upload part %d: %w", partNum, err)
+		}
+		w.cancel()
+	} else {
+		w.parts = append(w.parts, types.CompletedPart{
+			PartNumber:    aws.Int32(partNum),
+			ETag:          result.ETag,
+			ChecksumCRC32: result.ChecksumCRC32,
+		})
+	}
+	w.mu.Unlock()
+
+	w.free <- data[:0]
+}
+
+// failed returns the first part upload error, if any
+func (w *StreamWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.ctx.Err() != nil {
+		return w.ctx.Err()
+	}
+	return nil
+}
+
+// Close uploads the remaining data and completes the multipart upload
+func (w *StreamWriter) Close() error {
+	if err := w.failed(); err != nil {
+		return w.CloseWithError(err)
+	}
+
+	if len(w.buf) > 0 || w.partNum == 0 {
+		w.partNum++
+		w.size += int64(len(w.buf))
+		w.wg.Add(1)
+		go w.uploadPart(w.partNum, w.buf)
+	}
+	w.wg.Wait()
+
+	if err := w.failed(); err != nil {
+		return w.CloseWithError(err)
+	}
+	defer w.cancel()
+
+	sort.Slice(w.parts, func(i, j int) bool {
+		return *w.parts[i].PartNumber < *w.parts[j].PartNumber
+	})
+
+	_, err := w.client.CompleteMultipartUpload(w.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.svc.cfg.S3.Bucket),
+		Key:             aws.String(w.key),
+		UploadId:        aws.String(w.uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: w.parts},
+	})
+	if err != nil {
+		w.abort()
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	w.svc.logger.Info("Streaming upload completed",
+		zap.String("s3_key", w.key),
+		zap.Int32("parts", w.partNum),
+		zap.Int64("size", w.size))
+
+	return nil
+}
+
+// CloseWithError aborts the multipart upload and returns err
+func (w *StreamWriter) CloseWithError(err error) error {
+	w.cancel()
+	w.wg.Wait()
+	w.abort()
+
+	if err == nil {
+		err = errors.New("upload aborted")
+	}
+	return err
+}
+
+// abort aborts the multipart upload, logging failures. It does not use the
+// writer context, which is usually cancelled by the time the upload is aborted.
+func (w *StreamWriter) abort() {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	_, err := w.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.svc.cfg.S3.Bucket),
+		Key:      aws.String(w.key),
+		UploadId: aws.String(w.uploadID),
+	})
+	if err != nil {
+		w.svc.logger.Error("Failed to abort multipart upload",
+			zap.String("s3_key", w.key),
+			zap.String("upload_id", w.uploadID),
+			zap.Error(err))
+		return
+	}
+
+	w.svc.logger.Warn("Aborted multipart upload",
+		zap.String("s3_key", w.key),
+		zap.String("upload_id", w.uploadID))
+}
+
+// partSize returns the configured multipart part size in bytes
+func (s *Service) partSize() int {
+	if s.cfg.S3.PartSizeMB > 0 {
+		return s.cfg.S3.PartSizeMB << 20
+	}
+	return defaultPartSizeMB << 20
+}
+
+// uploadConcurrency returns the configured number of parallel part uploads
+func (s *Service) uploadConcurrency() int {
+	if s.cfg.S3.UploadConcurrency > 0 {
+		return s.cfg.S3.UploadConcurrency
+	}
+	return defaultUploadConcurrency
+}
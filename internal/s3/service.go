@@ -2,14 +2,21 @@ package s3
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
 	"go.uber.org/zap"
 )
 
@@ -20,6 +27,12 @@ type Service struct {
 	client *s3.Client
 }
 
+// Service is a storage backend that can clean up unfinished multipart uploads
+var (
+	_ storage.Backend       = (*Service)(nil)
+	_ storage.UploadCleaner = (*Service)(nil)
+)
+
 // NewService creates a new S3 service
 func NewService(cfg *config.NodeConfig, logger *zap.Logger) *Service {
 	return &Service{
@@ -28,17 +41,60 @@ func NewService(cfg *config.NodeConfig, logger *zap.Logger) *Service {
 	}
 }
 
-// Upload uploads a file to S3
-func (s *Service) Upload(filePath, s3Key string) error {
+// Upload uploads a snapshot file and its sidecar files to S3
+func (s *Service) Upload(ctx context.Context, filePath, s3Key string) error {
+	// Load AWS configuration
+	awsCfg, err := s.loadAWSConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	// Create S3 client
+	s.client = s3.NewFromConfig(awsCfg, s.clientOptions)
+
+	// Store the archive checksum from the manifest so downloads can verify it
+	var metadata map[string]string
+	if manifest, err := snapshot.ReadManifest(filePath); err == nil && manifest.Archive.SHA256 != "" {
+		metadata = map[string]string{sha256MetadataKey: manifest.Archive.SHA256}
+	}
+
+	// Upload snapshot
+	format, _ := snapshot.FormatFromName(filePath)
+	if err := s.putFile(ctx, filePath, s3Key, format.ContentType(), metadata); err != nil {
+		return err
+	}
+
+	return s.UploadSidecars(ctx, filePath, s3Key)
+}
+
+// UploadSidecars uploads the sidecar files of a local snapshot next to its S3 key
+func (s *Service) UploadSidecars(ctx context.Context, filePath, s3Key string) error {
 	// Load AWS configuration
-	awsCfg, err := s.loadAWSConfig()
+	awsCfg, err := s.loadAWSConfig(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	// Create S3 client
-	s.client = s3.NewFromConfig(awsCfg)
+	s.client = s3.NewFromConfig(awsCfg, s.clientOptions)
+
+	// Upload sidecars next to the snapshot
+	for _, sidecar := range snapshot.Sidecars(filePath) {
+		if _, err := os.Stat(sidecar); os.IsNotExist(err) {
+			continue
+		}
+
+		sidecarKey := s3Key + strings.TrimPrefix(sidecar, filePath)
+		if err := s.putFile(ctx, sidecar, sidecarKey, "application/json", nil); err != nil {
+			return err
+		}
+	}
 
+	return nil
+}
+
+// putFile uploads a single file to S3 with optional object metadata
+func (s *Service) putFile(ctx context.Context, filePath, s3Key, contentType string, metadata map[string]string) error {
 	// Open file
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -58,13 +114,26 @@ func (s *Service) Upload(filePath, s3Key string) error {
 		zap.String("bucket", s.cfg.S3.Bucket),
 		zap.Int64("size", fileInfo.Size()))
 
+	// Large files are uploaded in resumable parts
+	if fileInfo.Size() > int64(s.partSize()) {
+		if err := s.uploadMultipart(ctx, file, fileInfo, s3Key, contentType, metadata); err != nil {
+			return fmt.Errorf("failed to upload to S3: %w", err)
+		}
+
+		s.logger.Info("File uploaded successfully",
+			zap.String("file", filePath),
+			zap.String("s3_key", s3Key))
+		return nil
+	}
+
 	// Upload to S3
-	_, err = s.client.PutObject(context.Background(), &s3.PutObjectInput{
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        aws.String(s.cfg.S3.Bucket),
 		Key:           aws.String(s3Key),
 		Body:          file,
 		ContentLength: aws.Int64(fileInfo.Size()),
-		ContentType:   aws.String("application/gzip"),
+		ContentType:   aws.String(contentType),
+		Metadata:      metadata,
 	})
 
 	if err != nil {
@@ -78,16 +147,17 @@ func (s *Service) Upload(filePath, s3Key string) error {
 	return nil
 }
 
-// Download downloads a file from S3
-func (s *Service) Download(s3Key, localPath string) error {
+// Download downloads a file from S3 in parallel byte ranges. An interrupted
+// download resumes from its .partial file as long as the object is unchanged.
+func (s *Service) Download(ctx context.Context, s3Key, localPath string) error {
 	// Load AWS configuration
-	awsCfg, err := s.loadAWSConfig()
+	awsCfg, err := s.loadAWSConfig(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	// Create S3 client
-	s.client = s3.NewFromConfig(awsCfg)
+	s.client = s3.NewFromConfig(awsCfg, s.clientOptions)
 
 	// Create local directory if it doesn't exist
 	dir := filepath.Dir(localPath)
@@ -95,33 +165,23 @@ func (s *Service) Download(s3Key, localPath string) error {
 		return fmt.Errorf("failed to create local directory: %w", err)
 	}
 
-	// Create local file
-	file, err := os.Create(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to create local file: %w", err)
-	}
-	defer file.Close()
-
 	s.logger.Info("Downloading file from S3",
 		zap.String("s3_key", s3Key),
 		zap.String("local_path", localPath),
 		zap.String("bucket", s.cfg.S3.Bucket))
 
-	// Download from S3
-	result, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+	// Get object size and ETag
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.cfg.S3.Bucket),
 		Key:    aws.String(s3Key),
 	})
-
 	if err != nil {
-		return fmt.Errorf("failed to download from S3: %w", err)
+		return fmt.Errorf("failed to get object info: %w", err)
 	}
-	defer result.Body.Close()
 
-	// Copy content to local file
-	_, err = file.ReadFrom(result.Body)
-	if err != nil {
-		return fmt.Errorf("failed to write to local file: %w", err)
+	// Download ranges in parallel
+	if err := s.downloadRanges(ctx, s3Key, localPath, head); err != nil {
+		return fmt.Errorf("failed to download from S3: %w", err)
 	}
 
 	s.logger.Info("File downloaded successfully",
@@ -131,18 +191,45 @@ func (s *Service) Download(s3Key, localPath string) error {
 	return nil
 }
 
-// List lists objects in S3 bucket with prefix
-func (s *Service) List(prefix string) ([]string, error) {
+// Open opens an S3 object for streaming reads. The caller must close the returned reader.
+func (s *Service) Open(ctx context.Context, s3Key string) (io.ReadCloser, error) {
+	// Load AWS configuration
+	awsCfg, err := s.loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	// Create S3 client
+	s.client = s3.NewFromConfig(awsCfg, s.clientOptions)
+
+	s.logger.Info("Opening S3 object for streaming",
+		zap.String("s3_key", s3Key),
+		zap.String("bucket", s.cfg.S3.Bucket))
+
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.cfg.S3.Bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object from S3: %w", err)
+	}
+
+	return result.Body, nil
+}
+
+// List lists objects in S3 bucket with prefix. Listings carry no user metadata,
+// Stat fetches it for a single object.
+func (s *Service) List(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
 	// Load AWS configuration
-	awsCfg, err := s.loadAWSConfig()
+	awsCfg, err := s.loadAWSConfig(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	// Create S3 client
-	s.client = s3.NewFromConfig(awsCfg)
+	s.client = s3.NewFromConfig(awsCfg, s.clientOptions)
 
-	var keys []string
+	var objects []storage.ObjectInfo
 
 	// List objects
 	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
@@ -151,36 +238,73 @@ func (s *Service) List(prefix string) ([]string, error) {
 	})
 
 	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(context.Background())
+		page, err := paginator.NextPage(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("failed to list S3 objects: %w", err)
 		}
 
 		for _, obj := range page.Contents {
-			keys = append(keys, *obj.Key)
+			objects = append(objects, storage.ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+				ETag:         aws.ToString(obj.ETag),
+			})
 		}
 	}
 
-	return keys, nil
+	return objects, nil
+}
+
+// Stat returns the size, modification time and user metadata of an S3 object
+func (s *Service) Stat(ctx context.Context, s3Key string) (*storage.ObjectInfo, error) {
+	// Load AWS configuration
+	awsCfg, err := s.loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	// Create S3 client
+	s.client = s3.NewFromConfig(awsCfg, s.clientOptions)
+
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.cfg.S3.Bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, fmt.Errorf("%w: %s", storage.ErrNotFound, s3Key)
+		}
+		return nil, fmt.Errorf("failed to get object info: %w", err)
+	}
+
+	return &storage.ObjectInfo{
+		Key:          s3Key,
+		Size:         aws.ToInt64(head.ContentLength),
+		LastModified: aws.ToTime(head.LastModified),
+		ETag:         aws.ToString(head.ETag),
+		Metadata:     head.Metadata,
+	}, nil
 }
 
 // Delete deletes an object from S3
-func (s *Service) Delete(s3Key string) error {
+func (s *Service) Delete(ctx context.Context, s3Key string) error {
 	// Load AWS configuration
-	awsCfg, err := s.loadAWSConfig()
+	awsCfg, err := s.loadAWSConfig(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	// Create S3 client
-	s.client = s3.NewFromConfig(awsCfg)
+	s.client = s3.NewFromConfig(awsCfg, s.clientOptions)
 
 	s.logger.Info("Deleting object from S3",
 		zap.String("s3_key", s3Key),
 		zap.String("bucket", s.cfg.S3.Bucket))
 
 	// Delete object
-	_, err = s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.cfg.S3.Bucket),
 		Key:    aws.String(s3Key),
 	})
@@ -194,7 +318,7 @@ func (s *Service) Delete(s3Key string) error {
 }
 
 // loadAWSConfig loads AWS configuration
-func (s *Service) loadAWSConfig() (aws.Config, error) {
+func (s *Service) loadAWSConfig(ctx context.Context) (aws.Config, error) {
 	var opts []func(*awsconfig.LoadOptions) error
 
 	// Set region
@@ -202,24 +326,44 @@ func (s *Service) loadAWSConfig() (aws.Config, error) {
 		opts = append(opts, awsconfig.WithRegion(s.cfg.S3.Region))
 	}
 
-	// Set custom endpoint if provided
-	if s.cfg.S3.Endpoint != "" {
-		opts = append(opts, awsconfig.WithEndpointResolverWithOptions(
-			aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-				return aws.Endpoint{
-					URL:               s.cfg.S3.Endpoint,
-					HostnameImmutable: true,
-					PartitionID:       "aws",
-				}, nil
-			}),
+	// Static credentials from config take precedence over the default chain
+	if s.cfg.S3.AccessKey != "" && s.cfg.S3.SecretKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(s.cfg.S3.AccessKey, s.cfg.S3.SecretKey, ""),
 		))
 	}
 
 	// Load configuration
-	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	return cfg, nil
 }
+
+// clientOptions applies the endpoint, TLS and addressing settings to an S3 client
+func (s *Service) clientOptions(o *s3.Options) {
+	useSSL := s.cfg.S3.UseSSL == nil || *s.cfg.S3.UseSSL
+
+	// Set custom endpoint if provided, an explicit scheme wins over use_ssl
+	if s.cfg.S3.Endpoint != "" {
+		endpoint := s.cfg.S3.Endpoint
+		if !strings.Contains(endpoint, "://") {
+			scheme := "https://"
+			if !useSSL {
+				scheme = "http://"
+			}
+			endpoint = scheme + endpoint
+		}
+		o.BaseEndpoint = aws.String(endpoint)
+	}
+	o.EndpointOptions.DisableHTTPS = !useSSL
+
+	// Custom endpoints such as MinIO and Ceph RGW default to path-style addressing
+	if s.cfg.S3.ForcePathStyle != nil {
+		o.UsePathStyle = *s.cfg.S3.ForcePathStyle
+	} else {
+		o.UsePathStyle = s.cfg.S3.Endpoint != ""
+	}
+}
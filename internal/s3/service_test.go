@@ -0,0 +1,456 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"go.uber.org/zap"
+)
+
+const testBucket = "snapshots"
+
+// fakeObject is an object stored by fakeS3
+type fakeObject struct {
+	data     []byte
+	etag     string
+	metadata map[string]string
+	// partSizes are the part sizes of an object completed from a multipart upload
+	partSizes []int
+}
+
+// fakeUpload is an unfinished multipart upload in fakeS3
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+	metadata  map[string]string
+	parts     map[int][]byte
+}
+
+// fakeS3 is an in-memory S3 endpoint serving the path-style requests the
+// service makes
+type fakeS3 struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]*fakeUpload
+	nextID  int
+	// requests counts requests by operation, e.g. "UploadPart"
+	requests map[string]int
+	// fail returns a status to fail an operation with, or 0 to serve it
+	fail func(op string, r *http.Request) int
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+
+	f := &fakeS3{
+		objects:  map[string]*fakeObject{},
+		uploads:  map[string]*fakeUpload{},
+		requests: map[string]int{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+// newTestService creates a service using fake with 1 MiB parts and a config
+// that ignores the shared AWS files of the machine
+func newTestService(t *testing.T, fake *fakeS3) *Service {
+	t.Helper()
+
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	cfg := &config.NodeConfig{}
+	cfg.S3.Bucket = testBucket
+	cfg.S3.Region = "us-east-1"
+	cfg.S3.AccessKey = "access"
+	cfg.S3.SecretKey = "secret"
+	cfg.S3.Endpoint = fake.URL
+	cfg.S3.PartSizeMB = 1
+	cfg.S3.UploadConcurrency = 2
+	cfg.S3.DownloadConcurrency = 2
+
+	return NewService(cfg, zap.NewNop())
+}
+
+// count returns how many requests of an operation were served
+func (f *fakeS3) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[op]
+}
+
+// object returns a stored object, or nil
+func (f *fakeS3) object(key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+// put stores an object as if it was uploaded in parts of partSize
+func (f *fakeS3) put(key string, data []byte, partSize int, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var parts [][]byte
+	for offset := 0; offset < len(data); offset += partSize {
+		parts = append(parts, data[offset:min(offset+partSize, len(data))])
+	}
+	f.objects[key] = newMultipartObject(parts, metadata)
+}
+
+// startUpload starts a multipart upload initiated at the given time
+func (f *fakeS3) startUpload(key string, initiated time.Time) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = &fakeUpload{key: key, initiated: initiated.UTC(), parts: map[int][]byte{}}
+	return id
+}
+
+// uploadIDs returns the IDs of the unfinished multipart uploads
+func (f *fakeS3) uploadIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ids []string
+	for id := range f.uploads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testBucket+"/")
+	if !ok && r.URL.Path != "/"+testBucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	var op string
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		op = "CreateMultipartUpload"
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		op = "UploadPart"
+	case r.Method == http.MethodGet && query.Has("uploadId"):
+		op = "ListParts"
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		op = "CompleteMultipartUpload"
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		op = "AbortMultipartUpload"
+	case r.Method == http.MethodGet && query.Has("uploads"):
+		op = "ListMultipartUploads"
+	case r.Method == http.MethodPut:
+		op = "PutObject"
+	case r.Method == http.MethodHead:
+		op = "HeadObject"
+	case r.Method == http.MethodGet:
+		op = "GetObject"
+	case r.Method == http.MethodDelete:
+		op = "DeleteObject"
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests[op]++
+	if f.fail != nil {
+		if status := f.fail(op, r); status != 0 {
+			writeError(w, status, "InjectedFailure")
+			return
+		}
+	}
+
+	switch op {
+	case "CreateMultipartUpload":
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = &fakeUpload{key: key, initiated: time.Now().UTC(), metadata: userMetadata(r.Header), parts: map[int][]byte{}}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: testBucket, Key: key, UploadId: id})
+
+	case "UploadPart":
+		upload := f.uploads[query.Get("uploadId")]
+		if upload == nil {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNum, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[partNum] = body
+		w.Header().Set("ETag", md5ETag(body))
+
+	case "ListParts":
+		upload := f.uploads[query.Get("uploadId")]
+		if upload == nil {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		type part struct {
+			PartNumber int
+			ETag       string
+			Size       int
+		}
+		var parts []part
+		for partNum, data := range upload.parts {
+			parts = append(parts, part{partNum, md5ETag(data), len(data)})
+		}
+		sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"ListPartsResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+			Part     []part
+		}{Bucket: testBucket, Key: key, UploadId: query.Get("uploadId"), Part: parts})
+
+	case "CompleteMultipartUpload":
+		upload := f.uploads[query.Get("uploadId")]
+		if upload == nil {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var parts [][]byte
+		for i, part := range complete.Part {
+			data, ok := upload.parts[part.PartNumber]
+			if !ok || part.PartNumber != i+1 || part.ETag != md5ETag(data) {
+				writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			parts = append(parts, data)
+		}
+		f.objects[upload.key] = newMultipartObject(parts, upload.metadata)
+		delete(f.uploads, query.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: testBucket, Key: upload.key, ETag: f.objects[upload.key].etag})
+
+	case "AbortMultipartUpload":
+		if f.uploads[query.Get("uploadId")] == nil {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case "ListMultipartUploads":
+		type upload struct {
+			Key       string
+			UploadId  string
+			Initiated time.Time
+		}
+		var uploads []upload
+		for id, u := range f.uploads {
+			if strings.HasPrefix(u.key, query.Get("prefix")) {
+				uploads = append(uploads, upload{u.key, id, u.initiated})
+			}
+		}
+		sort.Slice(uploads, func(i, j int) bool { return uploads[i].UploadId < uploads[j].UploadId })
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+			Bucket  string
+			Upload  []upload
+		}{Bucket: testBucket, Upload: uploads})
+
+	case "PutObject":
+		f.objects[key] = &fakeObject{data: body, etag: md5ETag(body), metadata: userMetadata(r.Header)}
+		w.Header().Set("ETag", f.objects[key].etag)
+
+	case "HeadObject":
+		obj := f.objects[key]
+		if obj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		size := len(obj.data)
+		if partNum, _ := strconv.Atoi(query.Get("partNumber")); partNum > 0 && len(obj.partSizes) > 0 {
+			size = obj.partSizes[partNum-1]
+		}
+		for k, v := range obj.metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+
+	case "GetObject":
+		obj := f.objects[key]
+		if obj == nil {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != obj.etag {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		w.Header().Set("ETag", obj.etag)
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			w.Write(obj.data)
+			return
+		}
+		end = min(end, len(obj.data)-1)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.data)))
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(obj.data[start : end+1])
+
+	case "DeleteObject":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// newMultipartObject assembles an object with the ETag S3 gives multipart uploads
+func newMultipartObject(parts [][]byte, metadata map[string]string) *fakeObject {
+	obj := &fakeObject{metadata: metadata}
+	var digests []byte
+	for _, part := range parts {
+		sum := md5.Sum(part)
+		digests = append(digests, sum[:]...)
+		obj.data = append(obj.data, part...)
+		obj.partSizes = append(obj.partSizes, len(part))
+	}
+	sum := md5.Sum(digests)
+	obj.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(parts))
+	return obj
+}
+
+// readBody reads a request body, decoding the aws-chunked encoding the SDK
+// uses for trailing checksums
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return body, err
+	}
+
+	var data []byte
+	for {
+		line, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, fmt.Errorf("truncated chunk")
+		}
+		sizeHex, _, _ := bytes.Cut(line, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil || int64(len(rest)) < size {
+			return nil, fmt.Errorf("invalid chunk")
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, rest[:size]...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+}
+
+// userMetadata returns the x-amz-meta-* headers of a request
+func userMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for name := range header {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+			metadata[key] = header.Get(name)
+		}
+	}
+	return metadata
+}
+
+func md5ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// testData returns size bytes that differ from part to part
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	return data
+}
+
+func TestUploadSmallFile(t *testing.T) {
+	fake := newFakeS3(t)
+	svc := newTestService(t, fake)
+
+	path := filepath.Join(t.TempDir(), "small.tar")
+	if err := os.WriteFile(path, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+snapshot.MetadataSuffix, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.Upload(context.Background(), path, "node/small.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj := fake.object("node/small.tar"); obj == nil || string(obj.data) != "archive" {
+		t.Errorf("archive not stored: %+v", obj)
+	}
+	if obj := fake.object("node/small.tar" + snapshot.MetadataSuffix); obj == nil || string(obj.data) != "{}" {
+		t.Errorf("metadata sidecar not stored: %+v", obj)
+	}
+	if fake.count("CreateMultipartUpload") != 0 {
+		t.Error("a file smaller than a part was uploaded in parts")
+	}
+}
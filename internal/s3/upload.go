@@ -0,0 +1,408 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// JournalSuffix is appended to a local file name to form its upload journal name
+	JournalSuffix = ".upload.json"
+	// maxPartAttempts is how many times a single part upload is tried
+	maxPartAttempts = 5
+)
+
+// partRetryBackoff is the initial delay between part upload attempts
+var partRetryBackoff = 2 * time.Second
+
+// uploadJournal records the progress of a multipart upload so it can be resumed
+type uploadJournal struct {
+	Bucket   string                `json:"bucket"`
+	Key      string                `json:"key"`
+	UploadID string                `json:"upload_id"`
+	Size     int64                 `json:"size"`
+	ModTime  time.Time             `json:"mod_time"`
+	PartSize int64                 `json:"part_size"`
+	Parts    map[int32]journalPart `json:"parts"`
+}
+
+// journalPart is a completed part of a multipart upload
+type journalPart struct {
+	ETag          string `json:"etag"`
+	ChecksumCRC32 string `json:"checksum_crc32,omitempty"`
+}
+
+// uploadMultipart uploads a large file in parallel parts. Progress is kept in a
+// journal next to the file, so an interrupted upload continues where it stopped.
+func (s *Service) uploadMultipart(ctx context.Context, file *os.File, fileInfo os.FileInfo, s3Key, contentType string, metadata map[string]string) error {
+	journalPath := s.journalPath(file.Name(), s3Key)
+	partSize := int64(s.partSize())
+
+	totalParts := (fileInfo.Size() + partSize - 1) / partSize
+	if totalParts > maxParts {
+		return fmt.Errorf("file needs %d parts of %d bytes, more than the S3 limit of %d, increase s3.part_size_mb", totalParts, partSize, maxParts)
+	}
+
+	// Resume a previous upload of the same file if possible
+	journal := s.resumeJournal(ctx, journalPath, fileInfo, s3Key, partSize)
+	if journal == nil {
+		result, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(s.cfg.S3.Bucket),
+			Key:         aws.String(s3Key),
+			ContentType: aws.String(contentType),
+			Metadata:    metadata,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create multipart upload: %w", err)
+		}
+
+		journal = &uploadJournal{
+			Bucket:   s.cfg.S3.Bucket,
+			Key:      s3Key,
+			UploadID: *result.UploadId,
+			Size:     fileInfo.Size(),
+			ModTime:  fileInfo.ModTime(),
+			PartSize: partSize,
+			Parts:    map[int32]journalPart{},
+		}
+		if err := writeJournal(journalPath, journal); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Info("Uploading file in parts",
+		zap.String("s3_key", s3Key),
+		zap.String("upload_id", journal.UploadID),
+		zap.Int64("parts", totalParts),
+		zap.Int("completed_parts", len(journal.Parts)),
+		zap.Int64("part_size", partSize),
+		zap.Int("concurrency", s.uploadConcurrency()))
+
+	// Queue the missing parts
+	pending := make(chan int32, totalParts)
+	for partNum := int32(1); int64(partNum) <= totalParts; partNum++ {
+		if _, done := journal.Parts[partNum]; !done {
+			pending <- partNum
+		}
+	}
+	close(pending)
+
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+
+	for i := 0; i < s.uploadConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNum := range pending {
+				offset := int64(partNum-1) * partSize
+				size := min(partSize, fileInfo.Size()-offset)
+
+				part, err := s.uploadPartWithRetry(partCtx, journal, partNum, io.NewSectionReader(file, offset, size))
+
+				mu.Lock()
+				if err == nil {
+					journal.Parts[partNum] = *part
+					err = writeJournal(journalPath, journal)
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		s.logger.Error("Multipart upload interrupted, rerun the upload to resume",
+			zap.String("s3_key", s3Key),
+			zap.String("upload_id", journal.UploadID),
+			zap.Int("completed_parts", len(journal.Parts)),
+			zap.String("journal", journalPath))
+		return firstErr
+	}
+
+	// Complete upload with parts in order
+	completed := make([]types.CompletedPart, 0, len(journal.Parts))
+	for partNum, part := range journal.Parts {
+		completed = append(completed, types.CompletedPart{
+			PartNumber:    aws.Int32(partNum),
+			ETag:          aws.String(part.ETag),
+			ChecksumCRC32: optionalString(part.ChecksumCRC32),
+		})
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.cfg.S3.Bucket),
+		Key:             aws.String(s3Key),
+		UploadId:        aws.String(journal.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	if err := os.Remove(journalPath); err != nil && !os.IsNotExist(err) {
+		s.logger.Warn("Failed to remove upload journal", zap.String("journal", journalPath), zap.Error(err))
+	}
+
+	return nil
+}
+
+// uploadPartWithRetry uploads a single part, retrying with exponential backoff
+func (s *Service) uploadPartWithRetry(ctx context.Context, journal *uploadJournal, partNum int32, body io.ReadSeeker) (*journalPart, error) {
+	backoff := partRetryBackoff
+
+	var lastErr error
+	for attempt := 1; attempt <= maxPartAttempts; attempt++ {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind part %d: %w", partNum, err)
+		}
+
+		result, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(journal.Bucket),
+			Key:        aws.String(journal.Key),
+			UploadId:   aws.String(journal.UploadID),
+			PartNumber: aws.Int32(partNum),
+			Body:       body,
+		})
+		if err == nil {
+			return &journalPart{
+				ETag:          aws.ToString(result.ETag),
+				ChecksumCRC32: aws.ToString(result.ChecksumCRC32),
+			}, nil
+		}
+		lastErr = err
+
+		if ctx.Err() != nil || attempt == maxPartAttempts {
+			break
+		}
+
+		s.logger.Warn("Part upload failed, retrying",
+			zap.Int32("part", partNum),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to upload part %d: %w", partNum, lastErr)
+		}
+	}
+
+	return nil, fmt.Errorf("failed to upload part %d: %w", partNum, lastErr)
+}
+
+// journalPath returns the upload journal of a file. The name includes a hash of
+// the endpoint, bucket and key, so uploads of one file to several destinations
+// keep separate journals.
+func (s *Service) journalPath(filePath, s3Key string) string {
+	sum := sha256.Sum256([]byte(s.cfg.S3.Endpoint + "\x00" + s.cfg.S3.Bucket + "\x00" + s3Key))
+	return fmt.Sprintf("%s.%s%s", filePath, hex.EncodeToString(sum[:4]), JournalSuffix)
+}
+
+// resumeJournal loads the upload journal of a file if it still matches the file
+// and the upload still exists in S3. Parts S3 does not know about are dropped.
+func (s *Service) resumeJournal(ctx context.Context, journalPath string, fileInfo os.FileInfo, s3Key string, partSize int64) *uploadJournal {
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		return nil
+	}
+
+	var journal uploadJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		s.logger.Warn("Ignoring unreadable upload journal", zap.String("journal", journalPath), zap.Error(err))
+		return nil
+	}
+
+	if journal.Bucket != s.cfg.S3.Bucket || journal.Key != s3Key || journal.Size != fileInfo.Size() ||
+		!journal.ModTime.Equal(fileInfo.ModTime()) || journal.PartSize != partSize {
+		s.logger.Info("Upload journal does not match file, starting over", zap.String("journal", journalPath))
+		return nil
+	}
+
+	// Confirm the parts with S3
+	uploaded := map[int32]string{}
+	paginator := s3.NewListPartsPaginator(s.client, &s3.ListPartsInput{
+		Bucket:   aws.String(journal.Bucket),
+		Key:      aws.String(journal.Key),
+		UploadId: aws.String(journal.UploadID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			s.logger.Info("Previous multipart upload is gone, starting over",
+				zap.String("upload_id", journal.UploadID),
+				zap.Error(err))
+			return nil
+		}
+		for _, part := range page.Parts {
+			uploaded[aws.ToInt32(part.PartNumber)] = aws.ToString(part.ETag)
+		}
+	}
+
+	if journal.Parts == nil {
+		journal.Parts = map[int32]journalPart{}
+	}
+	for partNum, part := range journal.Parts {
+		if uploaded[partNum] != part.ETag {
+			delete(journal.Parts, partNum)
+		}
+	}
+
+	s.logger.Info("Resuming multipart upload",
+		zap.String("s3_key", s3Key),
+		zap.String("upload_id", journal.UploadID),
+		zap.Int("completed_parts", len(journal.Parts)))
+
+	return &journal
+}
+
+// AbortStaleUploads aborts unfinished multipart uploads under prefix initiated
+// more than olderThan ago, except the ones still referenced by an upload journal
+// in journalDir
+func (s *Service) AbortStaleUploads(ctx context.Context, prefix, journalDir string, olderThan time.Duration) error {
+	// Load AWS configuration
+	awsCfg, err := s.loadAWSConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	// Create S3 client
+	s.client = s3.NewFromConfig(awsCfg, s.clientOptions)
+
+	keep := journaledUploads(journalDir)
+	cutoff := time.Now().Add(-olderThan)
+
+	paginator := s3.NewListMultipartUploadsPaginator(s.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.cfg.S3.Bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	var errs []error
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+
+		for _, upload := range page.Uploads {
+			uploadID := aws.ToString(upload.UploadId)
+			if keep[uploadID] {
+				continue
+			}
+
+			// A recent upload may be in progress elsewhere, e.g. a streamed run
+			if upload.Initiated == nil || upload.Initiated.After(cutoff) {
+				s.logger.Debug("Keeping recent multipart upload",
+					zap.String("s3_key", aws.ToString(upload.Key)),
+					zap.String("upload_id", uploadID),
+					zap.Timep("initiated", upload.Initiated))
+				continue
+			}
+
+			_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.cfg.S3.Bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to abort upload %s: %w", uploadID, err))
+				continue
+			}
+
+			s.logger.Info("Aborted stale multipart upload",
+				zap.String("s3_key", aws.ToString(upload.Key)),
+				zap.String("upload_id", uploadID),
+				zap.Timep("initiated", upload.Initiated))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// journaledUploads returns the upload IDs referenced by journals in dir
+func journaledUploads(dir string) map[string]bool {
+	ids := map[string]bool{}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ids
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), JournalSuffix) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		var journal uploadJournal
+		if err := json.Unmarshal(data, &journal); err == nil && journal.UploadID != "" {
+			ids[journal.UploadID] = true
+		}
+	}
+
+	return ids
+}
+
+// writeJournal atomically replaces the upload journal
+func writeJournal(journalPath string, journal *uploadJournal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload journal: %w", err)
+	}
+
+	tmpPath := journalPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write upload journal: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, journalPath); err != nil {
+		return fmt.Errorf("failed to write upload journal: %w", err)
+	}
+
+	return nil
+}
+
+// optionalString returns nil for an empty string
+func optionalString(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return aws.String(v)
+}
@@ -0,0 +1,201 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fastRetries shortens the delay between part and range attempts for a test
+func fastRetries(t *testing.T) {
+	t.Helper()
+
+	backoff := partRetryBackoff
+	partRetryBackoff = time.Millisecond
+	t.Cleanup(func() { partRetryBackoff = backoff })
+}
+
+// writeArchive writes size bytes of test data to a local archive
+func writeArchive(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+
+	data := testData(size)
+	path := filepath.Join(t.TempDir(), "test-1-snapshot-100.tar")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// failParts fails every attempt of the given part numbers
+func failParts(parts ...string) func(op string, r *http.Request) int {
+	return func(op string, r *http.Request) int {
+		if op == "UploadPart" && slices.Contains(parts, r.URL.Query().Get("partNumber")) {
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	fake := newFakeS3(t)
+	svc := newTestService(t, fake)
+	path, data := writeArchive(t, 5<<19)
+
+	if err := svc.Upload(context.Background(), path, "node/archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("node/archive.tar")
+	if obj == nil || !bytes.Equal(obj.data, data) {
+		t.Fatal("uploaded object does not match the file")
+	}
+	if !slices.Equal(obj.partSizes, []int{1 << 20, 1 << 20, 1 << 19}) {
+		t.Errorf("part sizes = %v", obj.partSizes)
+	}
+	if journals, _ := filepath.Glob(path + ".*" + JournalSuffix); len(journals) != 0 {
+		t.Errorf("journal left behind: %v", journals)
+	}
+}
+
+func TestUploadMultipartResumesJournal(t *testing.T) {
+	fastRetries(t)
+	fake := newFakeS3(t)
+	svc := newTestService(t, fake)
+	svc.cfg.S3.UploadConcurrency = 1
+	path, data := writeArchive(t, 5<<19)
+	journalPath := svc.journalPath(path, "node/archive.tar")
+
+	// The last part keeps failing, the first two are journaled
+	fake.fail = failParts("3")
+	if err := svc.Upload(context.Background(), path, "node/archive.tar"); err == nil {
+		t.Fatal("upload succeeded although a part failed")
+	}
+	if got := fake.count("UploadPart"); got != 2+maxPartAttempts {
+		t.Errorf("UploadPart requests = %d, want %d", got, 2+maxPartAttempts)
+	}
+	if _, err := os.Stat(journalPath); err != nil {
+		t.Fatalf("journal missing after failed upload: %v", err)
+	}
+
+	// The rerun confirms the journaled parts and only uploads the missing one
+	fake.fail = nil
+	if err := svc.Upload(context.Background(), path, "node/archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.count("CreateMultipartUpload"); got != 1 {
+		t.Errorf("CreateMultipartUpload requests = %d, want 1", got)
+	}
+	if got := fake.count("ListParts"); got != 1 {
+		t.Errorf("ListParts requests = %d, want 1", got)
+	}
+	if got := fake.count("UploadPart"); got != 3+maxPartAttempts {
+		t.Errorf("UploadPart requests = %d, want %d", got, 3+maxPartAttempts)
+	}
+	if obj := fake.object("node/archive.tar"); obj == nil || !bytes.Equal(obj.data, data) {
+		t.Fatal("resumed object does not match the file")
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Errorf("journal left behind: %v", err)
+	}
+}
+
+func TestUploadMultipartRestartsGoneUpload(t *testing.T) {
+	fastRetries(t)
+	fake := newFakeS3(t)
+	svc := newTestService(t, fake)
+	path, data := writeArchive(t, 5<<19)
+
+	fake.fail = failParts("3")
+	if err := svc.Upload(context.Background(), path, "node/archive.tar"); err == nil {
+		t.Fatal("upload succeeded although a part failed")
+	}
+
+	// Someone aborted the upload in the meantime
+	fake.mu.Lock()
+	clear(fake.uploads)
+	fake.mu.Unlock()
+
+	fake.fail = nil
+	if err := svc.Upload(context.Background(), path, "node/archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.count("CreateMultipartUpload"); got != 2 {
+		t.Errorf("CreateMultipartUpload requests = %d, want 2", got)
+	}
+	if obj := fake.object("node/archive.tar"); obj == nil || !bytes.Equal(obj.data, data) {
+		t.Fatal("restarted object does not match the file")
+	}
+}
+
+func TestUploadMultipartRetriesPart(t *testing.T) {
+	fastRetries(t)
+	fake := newFakeS3(t)
+	svc := newTestService(t, fake)
+	path, data := writeArchive(t, 5<<19)
+
+	// Part 2 fails twice, then goes through
+	failures := 0
+	fake.fail = func(op string, r *http.Request) int {
+		if op == "UploadPart" && r.URL.Query().Get("partNumber") == "2" && failures < 2 {
+			failures++
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+
+	if err := svc.Upload(context.Background(), path, "node/archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if failures != 2 {
+		t.Errorf("part 2 failed %d times, want 2", failures)
+	}
+	if obj := fake.object("node/archive.tar"); obj == nil || !bytes.Equal(obj.data, data) {
+		t.Fatal("uploaded object does not match the file")
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	fake := newFakeS3(t)
+	svc := newTestService(t, fake)
+	old := time.Now().Add(-2 * time.Hour)
+
+	stale := fake.startUpload("node/stale.tar", old)
+	recent := fake.startUpload("node/recent.tar", time.Now())
+	journaled := fake.startUpload("node/journaled.tar", old)
+	other := fake.startUpload("other/stale.tar", old)
+
+	// A local upload journal still references one of the old uploads
+	journalDir := t.TempDir()
+	journal := &uploadJournal{Bucket: testBucket, Key: "node/journaled.tar", UploadID: journaled}
+	if err := writeJournal(filepath.Join(journalDir, "journaled.tar.0000"+JournalSuffix), journal); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.AbortStaleUploads(context.Background(), "node/", journalDir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{recent, journaled, other}
+	slices.Sort(want)
+	if got := fake.uploadIDs(); !slices.Equal(got, want) {
+		t.Errorf("remaining uploads = %v, want %v without %s", got, want, stale)
+	}
+
+	// Failed aborts are reported
+	fake.startUpload("node/stale.tar", old)
+	fake.fail = func(op string, r *http.Request) int {
+		if op == "AbortMultipartUpload" {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	if err := svc.AbortStaleUploads(context.Background(), "node/", journalDir, time.Hour); err == nil {
+		t.Error("failed abort was not reported")
+	}
+}
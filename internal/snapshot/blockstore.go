@@ -0,0 +1,159 @@
+package snapshot
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// blockStoreDB is the CometBFT block store in the node data directory
+	blockStoreDB = "blockstore.db"
+
+	// blockStoreStateKey holds the base and height of the block store
+	blockStoreStateKey = "blockStore"
+)
+
+// storedBlock is the latest block in the block store of a stopped node
+type storedBlock struct {
+	Height  int64
+	Hash    string
+	AppHash string
+	Time    time.Time
+}
+
+// readBlockStore reads the latest block from the goleveldb block store in
+// dataPath. A running node holds the lock of the store and is refused.
+func readBlockStore(dataPath, chainID string) (*storedBlock, error) {
+	db, err := leveldb.OpenFile(filepath.Join(dataPath, blockStoreDB), &opt.Options{
+		ReadOnly:       true,
+		ErrorIfMissing: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block store: %w", err)
+	}
+	defer db.Close()
+
+	state, err := db.Get([]byte(blockStoreStateKey), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block store state: %w", err)
+	}
+
+	// BlockStoreState: base = 1, height = 2
+	var height int64
+	if err := walkProto(state, func(num protowire.Number, v uint64, _ []byte) {
+		if num == 2 {
+			height = int64(v)
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("failed to decode block store state: %w", err)
+	}
+	if height <= 0 {
+		return nil, fmt.Errorf("block store is empty")
+	}
+
+	data, err := db.Get([]byte(fmt.Sprintf("H:%d", height)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block %d: %w", height, err)
+	}
+
+	block, storedChainID, err := decodeBlockMeta(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block %d: %w", height, err)
+	}
+	if block.Height != height || storedChainID != chainID {
+		return nil, fmt.Errorf("block store holds block %d of %s, expected block %d of %s",
+			block.Height, storedChainID, height, chainID)
+	}
+
+	return block, nil
+}
+
+// decodeBlockMeta decodes a BlockMeta and returns the block and its chain ID
+func decodeBlockMeta(data []byte) (*storedBlock, string, error) {
+	block := &storedBlock{}
+	var chainID string
+
+	var err error
+	walkErr := walkProto(data, func(num protowire.Number, _ uint64, field []byte) {
+		switch num {
+		case 1: // BlockID: hash = 1
+			err = errors.Join(err, walkProto(field, func(num protowire.Number, _ uint64, field []byte) {
+				if num == 1 {
+					block.Hash = hexBytes(field)
+				}
+			}))
+		case 3: // Header: chain_id = 2, height = 3, time = 4, app_hash = 11
+			err = errors.Join(err, walkProto(field, func(num protowire.Number, v uint64, field []byte) {
+				switch num {
+				case 2:
+					chainID = string(field)
+				case 3:
+					block.Height = int64(v)
+				case 4:
+					var seconds, nanos uint64
+					err = errors.Join(err, walkProto(field, func(num protowire.Number, v uint64, _ []byte) {
+						switch num {
+						case 1:
+							seconds = v
+						case 2:
+							nanos = v
+						}
+					}))
+					block.Time = time.Unix(int64(seconds), int64(nanos)).UTC()
+				case 11:
+					block.AppHash = hexBytes(field)
+				}
+			}))
+		}
+	})
+
+	return block, chainID, errors.Join(walkErr, err)
+}
+
+// walkProto calls fn with every field of an encoded protobuf message, passing
+// the value of varint fields and the contents of length-delimited ones
+func walkProto(data []byte, fn func(num protowire.Number, v uint64, field []byte)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			if n >= 0 {
+				fn(num, v, nil)
+			}
+		case protowire.BytesType:
+			var field []byte
+			field, n = protowire.ConsumeBytes(data)
+			if n >= 0 {
+				fn(num, 0, field)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// hexBytes formats a hash the way CometBFT RPC reports it
+func hexBytes(b []byte) string {
+	return strings.ToUpper(hex.EncodeToString(b))
+}
@@ -0,0 +1,206 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/syndtr/goleveldb/leveldb"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// blockTime is the time of the blocks written by writeBlockStore
+var blockTime = time.Date(2024, 5, 1, 10, 0, 0, 500, time.UTC)
+
+// writeBlockStore writes a block store whose latest block is height, the way
+// CometBFT encodes it
+func writeBlockStore(t *testing.T, dataPath, chainID string, height int64) {
+	t.Helper()
+
+	db, err := leveldb.OpenFile(filepath.Join(dataPath, blockStoreDB), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var state []byte
+	state = protowire.AppendTag(state, 1, protowire.VarintType)
+	state = protowire.AppendVarint(state, 1)
+	state = protowire.AppendTag(state, 2, protowire.VarintType)
+	state = protowire.AppendVarint(state, uint64(height))
+
+	var timestamp []byte
+	timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, uint64(blockTime.Unix()))
+	timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, uint64(blockTime.Nanosecond()))
+
+	var header []byte
+	header = protowire.AppendTag(header, 2, protowire.BytesType)
+	header = protowire.AppendString(header, chainID)
+	header = protowire.AppendTag(header, 3, protowire.VarintType)
+	header = protowire.AppendVarint(header, uint64(height))
+	header = protowire.AppendTag(header, 4, protowire.BytesType)
+	header = protowire.AppendBytes(header, timestamp)
+	header = protowire.AppendTag(header, 11, protowire.BytesType)
+	header = protowire.AppendBytes(header, []byte{0xab, 0xcd})
+
+	var blockID []byte
+	blockID = protowire.AppendTag(blockID, 1, protowire.BytesType)
+	blockID = protowire.AppendBytes(blockID, []byte{0x01, 0xff})
+
+	var meta []byte
+	meta = protowire.AppendTag(meta, 1, protowire.BytesType)
+	meta = protowire.AppendBytes(meta, blockID)
+	meta = protowire.AppendTag(meta, 2, protowire.VarintType)
+	meta = protowire.AppendVarint(meta, 1234)
+	meta = protowire.AppendTag(meta, 3, protowire.BytesType)
+	meta = protowire.AppendBytes(meta, header)
+
+	if err := db.Put([]byte(blockStoreStateKey), state, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte(fmt.Sprintf("H:%d", height)), meta, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBlockStore(t *testing.T) {
+	dataPath := t.TempDir()
+	writeBlockStore(t, dataPath, "test-1", 105)
+
+	block, err := readBlockStore(dataPath, "test-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := storedBlock{Height: 105, Hash: "01FF", AppHash: "ABCD", Time: blockTime}
+	if *block != want {
+		t.Errorf("block = %+v, want %+v", *block, want)
+	}
+
+	if _, err := readBlockStore(dataPath, "other-1"); err == nil {
+		t.Error("read the block store of another chain")
+	}
+
+	if _, err := readBlockStore(t.TempDir(), "test-1"); err == nil {
+		t.Error("read a missing block store")
+	}
+
+	// A running node holds the store open
+	db, err := leveldb.OpenFile(filepath.Join(dataPath, blockStoreDB), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := readBlockStore(dataPath, "test-1"); err == nil {
+		t.Error("read the block store of a running node")
+	}
+}
+
+// newStoppedService creates a service for a node managed by shell commands
+// around a flag file, with an RPC endpoint reporting height 100
+func newStoppedService(t *testing.T) (*Service, string) {
+	t.Helper()
+
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"result": map[string]any{
+			"node_info": map[string]any{"network": "test-1", "version": "0.38.0"},
+			"sync_info": map[string]any{"latest_block_height": "100", "latest_app_hash": "OLD"},
+		}})
+	}))
+	t.Cleanup(rpcServer.Close)
+
+	root := t.TempDir()
+	running := filepath.Join(root, "running")
+	cfg := &config.NodeConfig{}
+	cfg.Node.HomeDir = filepath.Join(root, "home")
+	cfg.Node.DataDir = "data"
+	cfg.Node.ChainID = "test-1"
+	cfg.Node.RPCEndpoint = rpcServer.URL
+	cfg.Node.Lifecycle = config.LifecycleConfig{
+		Type:          config.LifecycleCommand,
+		StopCommand:   "rm " + running,
+		StartCommand:  "touch " + running,
+		StatusCommand: "test -f " + running,
+		StartTimeout:  5 * time.Second,
+	}
+	cfg.Snapshot.TempDir = filepath.Join(root, "tmp")
+	cfg.Snapshot.Compression = string(FormatNone)
+
+	if err := os.MkdirAll(cfg.GetNodeDataPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewService(cfg, zap.NewNop()), running
+}
+
+func TestCreateStopped(t *testing.T) {
+	svc, running := newStoppedService(t)
+	writeBlockStore(t, svc.cfg.GetNodeDataPath(), "test-1", 105)
+
+	// Blocks committed after the status query are named after the stored height
+	if err := os.WriteFile(running, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path, err := svc.Create(context.Background(), CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(filepath.Base(path), "-snapshot-105-") {
+		t.Errorf("archive %s is not named after the stored height", path)
+	}
+	meta, err := ReadMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Height != 105 || meta.AppHash != "ABCD" || meta.Network != "test-1" {
+		t.Errorf("metadata = %+v", meta)
+	}
+	if _, err := os.Stat(running); err != nil {
+		t.Error("node was not started again")
+	}
+
+	// A node that was not running is archived with its stored height
+	if err := os.Remove(running); err != nil {
+		t.Fatal(err)
+	}
+	path, err = svc.Create(context.Background(), CreateOptions{RequireMetadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(filepath.Base(path), "-snapshot-105-") {
+		t.Errorf("archive %s is not named after the stored height", path)
+	}
+	if _, err := os.Stat(running); err == nil {
+		t.Error("a stopped node was started")
+	}
+}
+
+func TestCreateStoppedWithoutBlockStore(t *testing.T) {
+	svc, running := newStoppedService(t)
+	if err := os.WriteFile(running, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The height queried before the stop is not trusted
+	path, err := svc.Create(context.Background(), CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := ParseName("test-1", filepath.Base(path)); name.Height != 0 {
+		t.Errorf("archive %s carries a height", path)
+	}
+
+	if _, err := svc.Create(context.Background(), CreateOptions{RequireMetadata: true}); err == nil {
+		t.Error("created a snapshot without a height although metadata is required")
+	}
+}
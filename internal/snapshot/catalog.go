@@ -0,0 +1,161 @@
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/retention"
+	"go.uber.org/zap"
+)
+
+const (
+	// PartialSuffix marks an archive that is still being written
+	PartialSuffix = ".partial"
+
+	// downloadStateSuffix marks the progress file of a resumable download
+	downloadStateSuffix = ".json"
+
+	// abandonedAfter is how long an unfinished archive or orphaned sidecar has to
+	// sit untouched before it is treated as left over from a crashed run rather
+	// than still being written
+	abandonedAfter = time.Hour
+)
+
+// LocalSnapshot is a completed snapshot archive of this chain in the snapshot directory
+type LocalSnapshot struct {
+	Name
+	Path string
+	Size int64
+	// Pending is set while the archive has not reached every required destination
+	Pending bool
+}
+
+// Catalog returns the completed snapshot archives of this chain in the snapshot
+// directory, oldest first. Files of other chains and foreign files are ignored.
+func (s *Service) Catalog() ([]LocalSnapshot, error) {
+	snapshots, _, err := s.scan()
+	return snapshots, err
+}
+
+// scan reads the snapshot directory and returns this chain's completed archives,
+// oldest first, and the files crashed runs left behind: partial archives and
+// sidecars whose archive is gone. Archives without a manifest were not written
+// by this tool, e.g. copied in by hand, and are left alone.
+func (s *Service) scan() ([]LocalSnapshot, []retention.Decision, error) {
+	dir := s.cfg.GetSnapshotPath()
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+
+	names := map[string]bool{}
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+
+	var snapshots []LocalSnapshot
+	var abandoned []retention.Decision
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			s.logger.Warn("Failed to get file info", zap.String("file", entry.Name()), zap.Error(err))
+			continue
+		}
+		stale := time.Since(info.ModTime()) > abandonedAfter
+
+		// Partially written archives, unless they belong to a resumable download
+		if archive, ok := strings.CutSuffix(entry.Name(), PartialSuffix); ok {
+			if _, ours := ParseName(s.cfg.Node.ChainID, archive); ours && stale && !names[entry.Name()+downloadStateSuffix] {
+				abandoned = append(abandoned, leftover(entry.Name(), "unfinished archive of an interrupted run"))
+			}
+			continue
+		}
+
+		// Sidecars written before a crash kept their archive from being renamed into place
+		if archive, ok := sidecarArchive(entry.Name()); ok {
+			if _, ours := ParseName(s.cfg.Node.ChainID, archive); ours && stale && !names[archive] && !names[archive+PartialSuffix] {
+				abandoned = append(abandoned, leftover(entry.Name(), "sidecar without archive"))
+			}
+			continue
+		}
+
+		name, ok := ParseName(s.cfg.Node.ChainID, entry.Name())
+		if !ok {
+			continue
+		}
+
+		// Only archives with a manifest are ours to manage
+		if !names[entry.Name()+ManifestSuffix] {
+			continue
+		}
+
+		snapshots = append(snapshots, LocalSnapshot{
+			Name:    name,
+			Path:    filepath.Join(dir, entry.Name()),
+			Size:    info.Size(),
+			Pending: names[entry.Name()+PendingSuffix],
+		})
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Before(snapshots[j].Name)
+	})
+
+	return snapshots, abandoned, nil
+}
+
+// leftover is the decision to remove a file left behind by a crashed run
+func leftover(name, reason string) retention.Decision {
+	return retention.Decision{Item: retention.Item{Key: name}, Reason: reason}
+}
+
+// sidecarArchive returns the archive name a sidecar file belongs to
+func sidecarArchive(name string) (string, bool) {
+	for _, suffix := range []string{MetadataSuffix, ManifestSuffix} {
+		if archive, ok := strings.CutSuffix(name, suffix); ok {
+			return archive, true
+		}
+	}
+	return "", false
+}
+
+// removeArchive removes an archive from the snapshot directory together with its
+// sidecars and other files derived from it, like upload journals
+func (s *Service) removeArchive(name string) error {
+	dir := s.cfg.GetSnapshotPath()
+
+	if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove snapshot: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name+".") {
+			continue
+		}
+		related := filepath.Join(dir, entry.Name())
+		if err := os.Remove(related); err != nil && !os.IsNotExist(err) {
+			s.logger.Warn("Failed to remove snapshot sidecar",
+				zap.String("file", related),
+				zap.Error(err))
+		}
+	}
+
+	return nil
+}
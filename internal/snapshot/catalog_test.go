@@ -0,0 +1,91 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"go.uber.org/zap"
+)
+
+func TestScan(t *testing.T) {
+	cfg := &config.NodeConfig{}
+	cfg.Node.ChainID = "test-1"
+	cfg.Snapshot.TempDir = t.TempDir()
+	svc := NewService(cfg, zap.NewNop())
+
+	dir := cfg.GetSnapshotPath()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	archive := func(height int64) string {
+		return ArchiveName("test-1", height, created.Add(time.Duration(height)*time.Minute), FormatGzip.Extension())
+	}
+	stale := time.Now().Add(-2 * abandonedAfter)
+
+	files := map[string]time.Time{
+		// Finished archive
+		archive(1):                  stale,
+		archive(1) + MetadataSuffix: stale,
+		archive(1) + ManifestSuffix: stale,
+		// Archive copied in by hand
+		archive(2): stale,
+		// Partial archives, one still being written and one with download progress
+		archive(3) + PartialSuffix:                       stale,
+		archive(4) + PartialSuffix:                       time.Now(),
+		archive(5) + PartialSuffix:                       stale,
+		archive(5) + PartialSuffix + downloadStateSuffix: stale,
+		// Sidecars of a run that crashed before the rename, and of one still running
+		archive(6) + MetadataSuffix: stale,
+		archive(6) + ManifestSuffix: stale,
+		archive(7) + MetadataSuffix: time.Now(),
+		archive(8) + PartialSuffix:  time.Now(),
+		archive(8) + MetadataSuffix: stale,
+		// Other chains are left alone
+		ArchiveName("other-1", 1, created, FormatGzip.Extension()) + PartialSuffix: stale,
+	}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, abandoned, err := svc.scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) != 1 || filepath.Base(snapshots[0].Path) != archive(1) {
+		t.Errorf("snapshots = %v, want only %s", snapshots, archive(1))
+	}
+
+	var got []string
+	for _, decision := range abandoned {
+		got = append(got, decision.Key)
+	}
+	sort.Strings(got)
+	want := []string{
+		archive(3) + PartialSuffix,
+		archive(6) + ManifestSuffix,
+		archive(6) + MetadataSuffix,
+	}
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("abandoned = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("abandoned = %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Format is an archive compression format
+type Format string
+
+// Supported compression formats
+const (
+	FormatNone Format = "none"
+	FormatGzip Format = "gzip"
+	FormatZstd Format = "zstd"
+	FormatLZ4  Format = "lz4"
+)
+
+// formats lists every format, most specific extension first
+var formats = []Format{FormatGzip, FormatZstd, FormatLZ4, FormatNone}
+
+// Stream headers used to detect the compression of an archive
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// Compressor block and window limits
+const (
+	defaultGzipBlockSize = 1 << 20
+	minGzipBlockSize     = 64 << 10
+	maxZstdWindowSize    = 8 << 20
+)
+
+// lz4BlockSizes lists the lz4 block sizes, smallest first
+var lz4BlockSizes = []lz4.BlockSize{lz4.Block64Kb, lz4.Block256Kb, lz4.Block1Mb, lz4.Block4Mb}
+
+// lz4Levels maps compression levels 1-9 onto lz4 levels
+var lz4Levels = []lz4.CompressionLevel{
+	lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5,
+	lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
+// Extension returns the archive file extension for the format
+func (f Format) Extension() string {
+	switch f {
+	case FormatGzip:
+		return ".tar.gz"
+	case FormatZstd:
+		return ".tar.zst"
+	case FormatLZ4:
+		return ".tar.lz4"
+	default:
+		return ".tar"
+	}
+}
+
+// ContentType returns the MIME type of archives in the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatGzip:
+		return "application/gzip"
+	case FormatZstd:
+		return "application/zstd"
+	case FormatLZ4:
+		return "application/x-lz4"
+	case FormatNone:
+		return "application/x-tar"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// FormatFromName returns the format of an archive from its file name
+func FormatFromName(name string) (Format, bool) {
+	for _, f := range formats {
+		if strings.HasSuffix(name, f.Extension()) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// compressOptions tunes the compressor of an archive
+type compressOptions struct {
+	// level is the format specific compression level, zero selects the default
+	level int
+	// workers is the number of blocks compressed in parallel, zero uses every CPU
+	workers int
+	// memory approximately bounds the compressor buffers in bytes, zero uses the format default
+	memory int64
+}
+
+// newCompressor wraps w with a block-parallel compressor for the format. Every
+// format still produces a single standard stream readable by stock tools.
+func newCompressor(w io.Writer, f Format, opts compressOptions) (io.WriteCloser, error) {
+	workers := opts.workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	// Each worker holds an input and an output buffer
+	var blockBudget int64
+	if opts.memory > 0 {
+		blockBudget = opts.memory / int64(2*workers)
+	}
+
+	switch f {
+	case FormatNone:
+		return nopWriteCloser{w}, nil
+	case FormatGzip:
+		level := opts.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gzipWriter, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		blockSize := int64(defaultGzipBlockSize)
+		if blockBudget > 0 {
+			blockSize = max(min(blockBudget, defaultGzipBlockSize), minGzipBlockSize)
+		}
+		if err := gzipWriter.SetConcurrency(int(blockSize), workers); err != nil {
+			return nil, fmt.Errorf("failed to set gzip concurrency: %w", err)
+		}
+		return gzipWriter, nil
+	case FormatZstd:
+		zstdOpts := []zstd.EOption{zstd.WithEncoderConcurrency(workers)}
+		if opts.level != 0 {
+			zstdOpts = append(zstdOpts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.level)))
+		}
+		if blockBudget > 0 {
+			window := int64(zstd.MinWindowSize)
+			for window*2 <= blockBudget && window*2 <= maxZstdWindowSize {
+				window *= 2
+			}
+			zstdOpts = append(zstdOpts, zstd.WithWindowSize(int(window)), zstd.WithLowerEncoderMem(true))
+		}
+		return zstd.NewWriter(w, zstdOpts...)
+	case FormatLZ4:
+		lz4Writer := lz4.NewWriter(w)
+		lz4Opts := []lz4.Option{lz4.ConcurrencyOption(workers)}
+		if opts.level != 0 {
+			if opts.level < 1 || opts.level > len(lz4Levels) {
+				return nil, fmt.Errorf("invalid lz4 level %d", opts.level)
+			}
+			lz4Opts = append(lz4Opts, lz4.CompressionLevelOption(lz4Levels[opts.level-1]))
+		}
+		if blockBudget > 0 {
+			blockSize := lz4BlockSizes[0]
+			for _, size := range lz4BlockSizes {
+				if int64(size) <= blockBudget {
+					blockSize = size
+				}
+			}
+			lz4Opts = append(lz4Opts, lz4.BlockSizeOption(blockSize))
+		}
+		if err := lz4Writer.Apply(lz4Opts...); err != nil {
+			return nil, fmt.Errorf("failed to configure lz4 writer: %w", err)
+		}
+		return lz4Writer, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression format: %s", f)
+	}
+}
+
+// newDecompressor detects the compression of r from its header and returns a
+// reader yielding the plain tar stream
+func newDecompressor(r io.Reader) (io.ReadCloser, Format, error) {
+	bufReader := bufio.NewReader(r)
+	magic, _ := bufReader.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzipReader, err := gzip.NewReader(bufReader)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		return gzipReader, FormatGzip, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(bufReader)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return zstdReader.IOReadCloser(), FormatZstd, nil
+	case bytes.HasPrefix(magic, lz4Magic):
+		return io.NopCloser(&eofReader{r: lz4.NewReader(bufReader)}), FormatLZ4, nil
+	default:
+		return io.NopCloser(bufReader), FormatNone, nil
+	}
+}
+
+// nopWriteCloser adds a no-op Close to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// eofReader keeps returning io.EOF once the wrapped reader reported it. The lz4
+// reader returns an error instead when read again after the end of the stream.
+type eofReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	if e.eof {
+		return 0, io.EOF
+	}
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		e.eof = true
+	}
+	return n, err
+}
@@ -0,0 +1,102 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// ManifestSuffix is appended to the archive name to form the manifest sidecar name
+const ManifestSuffix = ".manifest.json"
+
+// Manifest lists everything that went into a snapshot archive
+type Manifest struct {
+	ChainID   string      `json:"chain_id"`
+	Height    int64       `json:"height"`
+	CreatedAt time.Time   `json:"created_at"`
+	Archive   ArchiveInfo `json:"archive"`
+	Files     []FileEntry `json:"files"`
+}
+
+// ArchiveInfo describes the archive file itself
+type ArchiveInfo struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// FileEntry describes a single archived path
+type FileEntry struct {
+	Path     string    `json:"path"`
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	ModTime  time.Time `json:"mtime"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Linkname string    `json:"linkname,omitempty"`
+}
+
+// File entry types
+const (
+	EntryFile    = "file"
+	EntryDir     = "dir"
+	EntrySymlink = "symlink"
+)
+
+// hashWriter counts and hashes everything written through it
+type hashWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+// newHashWriter wraps w with SHA-256 hashing and byte counting
+func newHashWriter(w io.Writer) *hashWriter {
+	return &hashWriter{w: w, hash: sha256.New()}
+}
+
+func (h *hashWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// Sum returns the hex encoded SHA-256 of the written data
+func (h *hashWriter) Sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// writeManifest writes the manifest sidecar next to the archive
+func writeManifest(archivePath string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	if err := os.WriteFile(archivePath+ManifestSuffix, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// ReadManifest reads the manifest sidecar of an archive
+func ReadManifest(archivePath string) (*Manifest, error) {
+	data, err := os.ReadFile(archivePath + ManifestSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
@@ -0,0 +1,137 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MetadataSuffix is appended to the archive name to form the metadata sidecar name
+	MetadataSuffix = ".metadata.json"
+
+	// PendingSuffix marks a local archive that has not reached every required
+	// destination yet; such archives are never removed by Cleanup
+	PendingSuffix = ".pending.json"
+
+	// timestampLayout is the timestamp format embedded in snapshot names
+	timestampLayout = "2006-01-02-15-04-05"
+)
+
+// Metadata describes the chain state a snapshot was taken at
+type Metadata struct {
+	ChainID     string    `json:"chain_id"`
+	Network     string    `json:"network,omitempty"`
+	NodeVersion string    `json:"node_version,omitempty"`
+	Height      int64     `json:"height"`
+	BlockHash   string    `json:"block_hash,omitempty"`
+	AppHash     string    `json:"app_hash,omitempty"`
+	BlockTime   time.Time `json:"block_time"`
+	CreatedAt   time.Time `json:"created_at"`
+	Archive     string    `json:"archive"`
+}
+
+// Name holds the fields encoded in a snapshot archive name
+type Name struct {
+	ChainID string
+	Height  int64
+	Time    time.Time
+	Format  Format
+}
+
+// Before reports whether the snapshot was taken before other. Snapshots taken
+// within the same second are ordered by height.
+func (n Name) Before(other Name) bool {
+	if !n.Time.Equal(other.Time) {
+		return n.Time.Before(other.Time)
+	}
+	return n.Height < other.Height
+}
+
+// Sidecars returns the sidecar files that belong to an archive
+func Sidecars(archivePath string) []string {
+	return []string{archivePath + MetadataSuffix, archivePath + ManifestSuffix}
+}
+
+// IsSidecar reports whether name is a sidecar file rather than an archive
+func IsSidecar(name string) bool {
+	return strings.HasSuffix(name, MetadataSuffix) || strings.HasSuffix(name, ManifestSuffix)
+}
+
+// ArchiveName builds the archive file name for a snapshot. A zero height is left out.
+func ArchiveName(chainID string, height int64, t time.Time, ext string) string {
+	if height > 0 {
+		return fmt.Sprintf("%s-snapshot-%d-%s%s", chainID, height, t.Format(timestampLayout), ext)
+	}
+	return fmt.Sprintf("%s-snapshot-%s%s", chainID, t.Format(timestampLayout), ext)
+}
+
+// ParseName parses an archive name produced by ArchiveName for the given chain
+func ParseName(chainID, name string) (Name, bool) {
+	prefix := chainID + "-snapshot-"
+	if !strings.HasPrefix(name, prefix) {
+		return Name{}, false
+	}
+
+	format, ok := FormatFromName(name)
+	if !ok {
+		return Name{}, false
+	}
+	rest := strings.TrimSuffix(strings.TrimPrefix(name, prefix), format.Extension())
+
+	if len(rest) < len(timestampLayout) {
+		return Name{}, false
+	}
+	ts, err := time.ParseInLocation(timestampLayout, rest[len(rest)-len(timestampLayout):], time.Local)
+	if err != nil {
+		return Name{}, false
+	}
+
+	parsed := Name{ChainID: chainID, Time: ts, Format: format}
+
+	if head := rest[:len(rest)-len(timestampLayout)]; head != "" {
+		heightStr, ok := strings.CutSuffix(head, "-")
+		if !ok {
+			return Name{}, false
+		}
+		height, err := strconv.ParseInt(heightStr, 10, 64)
+		if err != nil || height <= 0 {
+			return Name{}, false
+		}
+		parsed.Height = height
+	}
+
+	return parsed, true
+}
+
+// writeMetadata writes the metadata sidecar next to the archive
+func writeMetadata(archivePath string, meta *Metadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	if err := os.WriteFile(archivePath+MetadataSuffix, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	return nil
+}
+
+// ReadMetadata reads the metadata sidecar of an archive
+func ReadMetadata(archivePath string) (*Metadata, error) {
+	data, err := os.ReadFile(archivePath + MetadataSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+
+	return &meta, nil
+}
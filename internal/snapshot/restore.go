@@ -0,0 +1,268 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"go.uber.org/zap"
+)
+
+// CheckDataDir makes sure the node data directory can receive a restored snapshot.
+// A non-empty directory is rejected unless moveAside is set.
+func (s *Service) CheckDataDir(moveAside bool) error {
+	empty, err := isEmptyDir(s.cfg.GetNodeDataPath())
+	if err != nil {
+		return err
+	}
+
+	if !empty && !moveAside {
+		return fmt.Errorf("data directory is not empty: %s", s.cfg.GetNodeDataPath())
+	}
+
+	return nil
+}
+
+// Restore extracts a snapshot next to the node data directory and only moves it
+// into place once it is complete, so a failed restore leaves the data directory
+// untouched. With moveAside a non-empty data directory is renamed next to the
+// original and its new location is returned. Cancelling ctx aborts the
+// extraction and leaves the data directory untouched.
+func (s *Service) Restore(ctx context.Context, r io.Reader, moveAside bool) (string, error) {
+	if err := s.CheckDataDir(moveAside); err != nil {
+		return "", err
+	}
+
+	dataPath := s.cfg.GetNodeDataPath()
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create node home directory: %w", err)
+	}
+
+	// Extract into a sibling so the final rename stays on one filesystem
+	stagingPath, err := os.MkdirTemp(filepath.Dir(dataPath), filepath.Base(dataPath)+".*.restoring")
+	if err != nil {
+		return "", fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	if err := s.Extract(ctx, r, stagingPath); err != nil {
+		if removeErr := os.RemoveAll(stagingPath); removeErr != nil {
+			s.logger.Warn("Failed to remove partial restore",
+				zap.String("path", stagingPath),
+				zap.Error(removeErr))
+		}
+		return "", err
+	}
+
+	// Move the existing data out of the way, an empty directory is just removed
+	var backupPath string
+	empty, err := isEmptyDir(dataPath)
+	switch {
+	case err != nil:
+		return "", err
+	case empty:
+		if err := os.Remove(dataPath); err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to remove empty data directory: %w", err)
+		}
+	case !moveAside:
+		return "", fmt.Errorf("data directory is not empty: %s (restored data kept in %s)", dataPath, stagingPath)
+	default:
+		backupPath = fmt.Sprintf("%s.%s.bak", dataPath, time.Now().Format("2006-01-02-15-04-05"))
+		if err := os.Rename(dataPath, backupPath); err != nil {
+			return "", fmt.Errorf("failed to move data directory aside: %w", err)
+		}
+
+		s.logger.Info("Moved existing data directory aside",
+			zap.String("data_path", dataPath),
+			zap.String("backup_path", backupPath))
+	}
+
+	if err := os.Rename(stagingPath, dataPath); err != nil {
+		// Put the previous data back so the node keeps a usable directory
+		if backupPath != "" {
+			if restoreErr := os.Rename(backupPath, dataPath); restoreErr != nil {
+				s.logger.Error("Failed to move previous data directory back",
+					zap.String("backup_path", backupPath),
+					zap.Error(restoreErr))
+			}
+		}
+		return "", fmt.Errorf("failed to move restored data into place: %w", err)
+	}
+
+	return backupPath, nil
+}
+
+// isEmptyDir reports whether dir is empty or missing
+func isEmptyDir(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read data directory: %w", err)
+	}
+	return len(entries) == 0, nil
+}
+
+// Extract unpacks a tar stream in any supported compression format into dataPath.
+// It stops early when ctx is cancelled.
+func (s *Service) Extract(ctx context.Context, r io.Reader, dataPath string) error {
+	s.logger.Info("Extracting snapshot",
+		zap.String("data_path", dataPath))
+
+	if err := os.MkdirAll(dataPath, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// Detect compression from the stream header
+	tarSource, format, err := newDecompressor(storage.NewContextReader(ctx, r))
+	if err != nil {
+		return err
+	}
+	defer tarSource.Close()
+
+	s.logger.Info("Detected snapshot compression", zap.String("format", string(format)))
+
+	// Create tar reader
+	tarReader := tar.NewReader(tarSource)
+
+	var files int
+	var size int64
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		target, err := safeJoin(dataPath, header.Name)
+		if err != nil {
+			return err
+		}
+
+		// Links created earlier in the archive must not redirect this entry
+		if err := checkParents(dataPath, target); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// An earlier symlink must not stand in for a directory
+			if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+				return fmt.Errorf("refusing directory %s over an existing non-directory", header.Name)
+			}
+			if err := os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0700); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", target, err)
+			}
+		case tar.TypeReg:
+			n, err := extractFile(tarReader, target, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			files++
+			size += n
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) {
+				return fmt.Errorf("refusing absolute symlink %s -> %s", header.Name, header.Linkname)
+			}
+			// Only leading ".." may climb, so the link can't leave the data
+			// directory by passing through another symlink
+			if filepath.Clean(header.Linkname) != header.Linkname {
+				return fmt.Errorf("refusing non-canonical symlink %s -> %s", header.Name, header.Linkname)
+			}
+			if _, err := safeJoin(dataPath, filepath.Join(filepath.Dir(header.Name), header.Linkname)); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create directory for %s: %w", target, err)
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", target, err)
+			}
+			continue
+		default:
+			s.logger.Warn("Skipping unsupported tar entry",
+				zap.String("name", header.Name),
+				zap.Uint8("type", header.Typeflag))
+			continue
+		}
+
+		if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+			s.logger.Warn("Failed to restore modification time", zap.String("path", target), zap.Error(err))
+		}
+	}
+
+	s.logger.Info("Snapshot extracted successfully",
+		zap.String("data_path", dataPath),
+		zap.Int("files", files),
+		zap.Int64("bytes", size))
+
+	return nil
+}
+
+// extractFile writes the current tar entry to target
+func extractFile(r io.Reader, target string, mode os.FileMode) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory for %s: %w", target, err)
+	}
+
+	// Never write through an existing file or symlink
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file %s: %w", target, err)
+	}
+
+	n, err := io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		return n, fmt.Errorf("failed to write file %s: %w", target, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return n, fmt.Errorf("failed to close file %s: %w", target, err)
+	}
+
+	return n, nil
+}
+
+// safeJoin joins name onto root and rejects entries that would escape it
+func safeJoin(root, name string) (string, error) {
+	target := filepath.Join(root, name)
+	if target != root && !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("refusing tar entry outside data directory: %s", name)
+	}
+	return target, nil
+}
+
+// checkParents rejects a target below root when one of its existing parent
+// directories is a symlink
+func checkParents(root, target string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return nil
+	}
+
+	// Check every existing parent below root, the first missing one ends the walk
+	path := root
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %w", path, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing tar entry through symlink %s: %s", path, target)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"go.uber.org/zap"
+)
+
+// entry is a tar entry of a test archive
+type entry struct {
+	name string
+	link string
+	body string
+	dir  bool
+}
+
+// buildTar writes entries into an uncompressed tar archive
+func buildTar(t *testing.T, entries []entry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		switch {
+		case e.dir:
+			header = &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeDir}
+		case e.link != "":
+			header = &tar.Header{Name: e.name, Linkname: e.link, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+// newRestoreService creates a service whose data directory sits two levels
+// below a fresh temp dir, so escapes land in directories the test can inspect
+func newRestoreService(t *testing.T) (*Service, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	cfg := &config.NodeConfig{}
+	cfg.Node.HomeDir = filepath.Join(root, "home")
+	cfg.Node.DataDir = "data"
+
+	return NewService(cfg, zap.NewNop()), root
+}
+
+func TestExtract(t *testing.T) {
+	svc, _ := newRestoreService(t)
+
+	archive := buildTar(t, []entry{
+		{name: "a/", dir: true},
+		{name: "a/b/f.txt", body: "hello"},
+		{name: "lnk", link: "a/b/f.txt"},
+		{name: "d/up", link: "../a"},
+	})
+	if err := svc.Extract(context.Background(), archive, svc.cfg.GetNodeDataPath()); err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(svc.cfg.GetNodeDataPath(), "d/up/b/f.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("restored file = %q, %v", data, err)
+	}
+}
+
+func TestExtractRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+		want    string
+	}{
+		{
+			name:    "parent traversal",
+			entries: []entry{{name: "../../evil", body: "x"}},
+			want:    "outside data directory",
+		},
+		{
+			name:    "absolute symlink",
+			entries: []entry{{name: "lnk", link: "/etc"}},
+			want:    "absolute symlink",
+		},
+		{
+			name:    "symlink leaving the data directory",
+			entries: []entry{{name: "lnk", link: "../.."}},
+			want:    "outside data directory",
+		},
+		{
+			name: "symlink chain",
+			entries: []entry{
+				{name: "sub/", dir: true},
+				{name: "sub/b", link: ".."},
+				{name: "a", link: "sub/b/../.."},
+				{name: "a/evil", body: "x"},
+			},
+			want: "non-canonical symlink",
+		},
+		{
+			name: "file through symlinked directory",
+			entries: []entry{
+				{name: "sub/", dir: true},
+				{name: "sub/b", link: ".."},
+				{name: "sub/b/b/evil", body: "x"},
+			},
+			want: "through symlink",
+		},
+		{
+			name: "directory over symlink",
+			entries: []entry{
+				{name: "up", link: "."},
+				{name: "up/", dir: true},
+			},
+			want: "existing non-directory",
+		},
+		{
+			name: "file over symlink",
+			entries: []entry{
+				{name: "f", link: "g"},
+				{name: "f", body: "x"},
+			},
+			want: "failed to create file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, root := newRestoreService(t)
+
+			err := svc.Extract(context.Background(), buildTar(t, tt.entries), svc.cfg.GetNodeDataPath())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Extract() error = %v, want %q", err, tt.want)
+			}
+
+			// Nothing may be written next to the data directory
+			for _, path := range []string{filepath.Join(root, "evil"), filepath.Join(root, "home", "evil"), filepath.Join(svc.cfg.GetNodeDataPath(), "g")} {
+				if _, err := os.Lstat(path); err == nil {
+					t.Fatalf("%s was written", path)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreKeepsDataOnFailure(t *testing.T) {
+	svc, _ := newRestoreService(t)
+	dataPath := svc.cfg.GetNodeDataPath()
+	if err := os.MkdirAll(dataPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataPath, "old"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.CheckDataDir(false); err == nil {
+		t.Fatal("CheckDataDir() accepted a non-empty data directory")
+	}
+
+	// A broken archive leaves the data directory and no staging directory behind
+	broken := buildTar(t, []entry{{name: "new", body: "new"}, {name: "../evil", body: "x"}})
+	if _, err := svc.Restore(context.Background(), broken, true); err == nil {
+		t.Fatal("Restore() of a broken archive succeeded")
+	}
+	if data, err := os.ReadFile(filepath.Join(dataPath, "old")); err != nil || string(data) != "old" {
+		t.Fatalf("data directory changed: %q, %v", data, err)
+	}
+	if leftovers, _ := filepath.Glob(dataPath + ".*"); len(leftovers) != 0 {
+		t.Fatalf("leftovers = %v", leftovers)
+	}
+
+	// A cancelled restore leaves it untouched as well
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := svc.Restore(ctx, buildTar(t, []entry{{name: "new", body: "new"}}), true); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Restore() with a cancelled context = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dataPath, "old")); err != nil || string(data) != "old" {
+		t.Fatalf("data directory changed: %q, %v", data, err)
+	}
+	if leftovers, _ := filepath.Glob(dataPath + ".*"); len(leftovers) != 0 {
+		t.Fatalf("leftovers = %v", leftovers)
+	}
+
+	// A complete archive replaces it and keeps the old data aside
+	backupPath, err := svc.Restore(context.Background(), buildTar(t, []entry{{name: "new", body: "new"}}), true)
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dataPath, "new")); err != nil || string(data) != "new" {
+		t.Fatalf("restored file = %q, %v", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(backupPath, "old")); err != nil || string(data) != "old" {
+		t.Fatalf("backup file = %q, %v", data, err)
+	}
+}
@@ -2,21 +2,40 @@ package snapshot
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/lifecycle"
+	"github.com/q163i/snapshot-cosmos/internal/retention"
+	"github.com/q163i/snapshot-cosmos/internal/rpc"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
 	"go.uber.org/zap"
 )
 
+// rpcTimeout bounds node status queries
+const rpcTimeout = 10 * time.Second
+
 // Service handles snapshot creation
 type Service struct {
 	cfg    *config.NodeConfig
 	logger *zap.Logger
+
+	// Progress of the archive being written
+	archivedFiles atomic.Int64
+	archivedBytes atomic.Int64
+}
+
+// Progress is how much of the data directory the archive being written covers
+type Progress struct {
+	Files int64
+	Bytes int64
 }
 
 // NewService creates a new snapshot service
@@ -27,8 +46,176 @@ func NewService(cfg *config.NodeConfig, logger *zap.Logger) *Service {
 	}
 }
 
-// Create creates a new snapshot of the blockchain node data
-func (s *Service) Create() (string, error) {
+// Progress returns how much of the data directory the archive being written, or
+// the last one written, covers
+func (s *Service) Progress() Progress {
+	return Progress{
+		Files: s.archivedFiles.Load(),
+		Bytes: s.archivedBytes.Load(),
+	}
+}
+
+// CreateOptions overrides the configured snapshot settings for a single run
+type CreateOptions struct {
+	// OutputPath is the archive path; a generated name under the snapshot path is used when empty
+	OutputPath string
+	// Uncompressed writes a plain tar archive regardless of the configured compression
+	Uncompressed bool
+	// RequireMetadata fails the snapshot when the node status can't be queried
+	// instead of taking it without height and chain state
+	RequireMetadata bool
+}
+
+// ArchiveWriter receives a streamed snapshot archive. CloseWithError discards
+// whatever was written so far.
+type ArchiveWriter interface {
+	io.WriteCloser
+	CloseWithError(err error) error
+}
+
+// Create creates a new snapshot of the blockchain node data. The archive is written
+// under a .partial name and only renamed into place once it is complete on disk;
+// on failure or cancellation nothing is left behind.
+func (s *Service) Create(ctx context.Context, opts CreateOptions) (string, error) {
+	format, err := s.prepare(opts)
+	if err != nil {
+		return "", err
+	}
+
+	// Write the archive under a temporary name
+	var snapshotPath, partialPath string
+	var archive *hashWriter
+	var files []FileEntry
+	meta, err := s.capture(ctx, opts.RequireMetadata, func(ctx context.Context, meta *Metadata) error {
+		snapshotPath = s.archivePath(meta, format, opts.OutputPath)
+		partialPath = snapshotPath + PartialSuffix
+		var err error
+		archive, files, err = s.writePartial(ctx, partialPath, format)
+		return err
+	})
+	if err != nil {
+		if partialPath != "" {
+			os.Remove(partialPath)
+		}
+		return "", err
+	}
+
+	if err := s.finish(snapshotPath, meta, format, archive, files); err != nil {
+		s.discard(snapshotPath)
+		return "", err
+	}
+
+	// Move the complete archive into place
+	if err := os.Rename(partialPath, snapshotPath); err != nil {
+		s.discard(snapshotPath)
+		return "", fmt.Errorf("failed to move snapshot into place: %w", err)
+	}
+
+	return snapshotPath, nil
+}
+
+// writePartial writes the archive to path and flushes it to disk
+func (s *Service) writePartial(ctx context.Context, path string, format Format) (*hashWriter, []FileEntry, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+
+	// Hash the archive while it is written
+	archiveWriter := newHashWriter(file)
+
+	files, err := s.writeArchive(ctx, archiveWriter, format)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to create tar archive: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to sync snapshot file: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to close snapshot file: %w", err)
+	}
+
+	return archiveWriter, files, nil
+}
+
+// discard removes an unfinished archive and the sidecars written for it
+func (s *Service) discard(snapshotPath string) {
+	for _, path := range append([]string{snapshotPath + PartialSuffix}, Sidecars(snapshotPath)...) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			s.logger.Warn("Failed to remove unfinished snapshot file",
+				zap.String("file", path),
+				zap.Error(err))
+		}
+	}
+}
+
+// Remove deletes a finished archive and its sidecars, e.g. one that failed verification
+func (s *Service) Remove(snapshotPath string) error {
+	if err := os.Remove(snapshotPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove snapshot: %w", err)
+	}
+	s.discard(snapshotPath)
+
+	return nil
+}
+
+// Stream creates a new snapshot without staging the archive on disk. The archive
+// is written to the writer returned by open; sidecars are still written under
+// the snapshot path and the returned path is where the archive would have been.
+func (s *Service) Stream(ctx context.Context, open func(name string, format Format) (ArchiveWriter, error)) (string, error) {
+	format, err := s.prepare(CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	var snapshotPath string
+	var w ArchiveWriter
+	var archiveWriter *hashWriter
+	var files []FileEntry
+	meta, err := s.capture(ctx, false, func(ctx context.Context, meta *Metadata) error {
+		snapshotPath = s.archivePath(meta, format, "")
+
+		// Open archive destination
+		var err error
+		w, err = open(meta.Archive, format)
+		if err != nil {
+			return fmt.Errorf("failed to open archive stream: %w", err)
+		}
+
+		// Hash the archive while it is written
+		archiveWriter = newHashWriter(w)
+
+		files, err = s.writeArchive(ctx, archiveWriter, format)
+		if err != nil {
+			return fmt.Errorf("failed to create tar archive: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		if w != nil {
+			return "", w.CloseWithError(err)
+		}
+		return "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to close archive stream: %w", err)
+	}
+
+	if err := s.finish(snapshotPath, meta, format, archiveWriter, files); err != nil {
+		return "", err
+	}
+
+	return snapshotPath, nil
+}
+
+// prepare picks the archive format and creates the directories the archive is
+// written to, before the node is touched
+func (s *Service) prepare(opts CreateOptions) (Format, error) {
 	s.logger.Info("Creating snapshot",
 		zap.String("data_path", s.cfg.GetNodeDataPath()),
 		zap.String("temp_dir", s.cfg.GetSnapshotPath()))
@@ -38,45 +225,203 @@ func (s *Service) Create() (string, error) {
 		return "", fmt.Errorf("failed to create temp directory: %w", err)
 	}
 
-	// Generate snapshot filename
-	timestamp := time.Now().Format("2006-01-02-15-04-05")
-	filename := fmt.Sprintf("%s-snapshot-%s.tar.gz", s.cfg.Node.ChainID, timestamp)
-	snapshotPath := filepath.Join(s.cfg.GetSnapshotPath(), filename)
+	// Select compression
+	format := Format(s.cfg.Snapshot.Compression)
+	if opts.Uncompressed {
+		format = FormatNone
+	}
 
-	// Create snapshot file
-	file, err := os.Create(snapshotPath)
+	if opts.OutputPath != "" {
+		// The extension tells readers and uploads how the archive is compressed
+		if !strings.HasSuffix(opts.OutputPath, format.Extension()) {
+			return "", fmt.Errorf("output path %s must end in %s to match the archive compression", opts.OutputPath, format.Extension())
+		}
+		if err := os.MkdirAll(filepath.Dir(opts.OutputPath), 0755); err != nil {
+			return "", fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
+	return format, nil
+}
+
+// capture reads the chain state and runs archive with it. With a lifecycle
+// controller the node is stopped while archive runs; its status is queried
+// before the stop, but the height and latest block are read from the block store
+// once it has exited, since the node keeps committing blocks until then.
+func (s *Service) capture(ctx context.Context, required bool, archive func(ctx context.Context, meta *Metadata) error) (*Metadata, error) {
+	controller, err := lifecycle.New(s.cfg, s.logger)
 	if err != nil {
-		return "", fmt.Errorf("failed to create snapshot file: %w", err)
+		return nil, err
+	}
+
+	var meta *Metadata
+	queryMetadata := func(ctx context.Context) error {
+		var err error
+		meta, err = s.queryMetadata(ctx, required)
+		return err
 	}
-	defer file.Close()
 
-	// Create gzip writer
-	gzipWriter := gzip.NewWriter(file)
-	defer gzipWriter.Close()
+	if controller == nil {
+		if err := queryMetadata(ctx); err != nil {
+			return nil, err
+		}
+		return meta, archive(ctx, meta)
+	}
+
+	err = lifecycle.WhileStopped(ctx, controller, s.cfg.Node.Lifecycle, s.logger, queryMetadata, func(ctx context.Context) error {
+		// A node that was not running has no RPC to query
+		if meta == nil {
+			meta = &Metadata{ChainID: s.cfg.Node.ChainID, CreatedAt: time.Now()}
+		}
+		if err := s.readStoppedState(meta, required); err != nil {
+			return err
+		}
+		return archive(ctx, meta)
+	})
+
+	return meta, err
+}
+
+// readStoppedState replaces the block recorded in meta with the latest block in
+// the block store of the stopped node. When the store can't be read the height
+// is left unknown rather than naming the archive after a height it may not match.
+func (s *Service) readStoppedState(meta *Metadata, required bool) error {
+	block, err := readBlockStore(s.cfg.GetNodeDataPath(), s.cfg.Node.ChainID)
+	if err != nil {
+		if required {
+			return fmt.Errorf("failed to read the height of the stopped node: %w", err)
+		}
+		s.logger.Warn("Failed to read the height of the stopped node, snapshot height will be unknown", zap.Error(err))
+		meta.Height, meta.BlockHash, meta.AppHash, meta.BlockTime = 0, "", "", time.Time{}
+		return nil
+	}
+
+	if meta.Height > 0 && meta.Height != block.Height {
+		s.logger.Info("Node committed blocks while stopping",
+			zap.Int64("status_height", meta.Height),
+			zap.Int64("stored_height", block.Height))
+	}
+
+	meta.Height = block.Height
+	meta.BlockHash = block.Hash
+	meta.AppHash = block.AppHash
+	meta.BlockTime = block.Time
+
+	s.logger.Info("Read height of the stopped node",
+		zap.Int64("height", meta.Height),
+		zap.String("app_hash", meta.AppHash))
+
+	return nil
+}
+
+// archivePath names the archive after the captured chain state, unless an
+// output path is given
+func (s *Service) archivePath(meta *Metadata, format Format, outputPath string) string {
+	snapshotPath := outputPath
+	if snapshotPath == "" {
+		snapshotPath = filepath.Join(s.cfg.GetSnapshotPath(), ArchiveName(s.cfg.Node.ChainID, meta.Height, meta.CreatedAt, format.Extension()))
+	}
+	meta.Archive = filepath.Base(snapshotPath)
+
+	return snapshotPath
+}
+
+// finish writes the metadata and manifest sidecars of a completed archive
+func (s *Service) finish(snapshotPath string, meta *Metadata, format Format, archive *hashWriter, files []FileEntry) error {
+	// Write metadata sidecar
+	if err := writeMetadata(snapshotPath, meta); err != nil {
+		return err
+	}
+
+	// Write manifest sidecar
+	manifest := &Manifest{
+		ChainID:   s.cfg.Node.ChainID,
+		Height:    meta.Height,
+		CreatedAt: meta.CreatedAt,
+		Archive: ArchiveInfo{
+			Name:   meta.Archive,
+			Size:   archive.size,
+			SHA256: archive.Sum(),
+		},
+		Files: files,
+	}
+	if err := writeManifest(snapshotPath, manifest); err != nil {
+		return err
+	}
+
+	s.logger.Info("Snapshot created successfully",
+		zap.String("path", snapshotPath),
+		zap.Int64("size_bytes", manifest.Archive.Size),
+		zap.String("compression", string(format)),
+		zap.Int("files", len(files)),
+		zap.String("sha256", manifest.Archive.SHA256),
+		zap.Int64("height", meta.Height),
+		zap.String("chain_id", s.cfg.Node.ChainID))
+
+	return nil
+}
+
+// writeArchive streams the node data directory as a tar compressed with format
+// into w and returns a manifest entry for every archived path. It stops early when
+// ctx is cancelled.
+func (s *Service) writeArchive(ctx context.Context, w io.Writer, format Format) ([]FileEntry, error) {
+	dataPath := s.cfg.GetNodeDataPath()
+
+	// Create compressor
+	compressor, err := newCompressor(w, format, compressOptions{
+		level:   s.cfg.Snapshot.CompressionLevel,
+		workers: s.cfg.Snapshot.CompressionWorkers,
+		memory:  int64(s.cfg.Snapshot.CompressionMemoryMB) << 20,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compressor: %w", err)
+	}
 
 	// Create tar writer
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+	tarWriter := tar.NewWriter(compressor)
+
+	var files []FileEntry
+	s.archivedFiles.Store(0)
+	s.archivedBytes.Store(0)
 
 	// Walk through the data directory and add files to tar
-	err = filepath.Walk(s.cfg.GetNodeDataPath(), func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(dataPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Skip the root directory
-		if path == s.cfg.GetNodeDataPath() {
+		if path == dataPath {
 			return nil
 		}
 
 		// Get relative path for tar
-		relPath, err := filepath.Rel(s.cfg.GetNodeDataPath(), path)
+		relPath, err := filepath.Rel(dataPath, path)
 		if err != nil {
 			return fmt.Errorf("failed to get relative path: %w", err)
 		}
 
+		// Only directories, regular files and symlinks are archived
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			s.logger.Warn("Skipping unsupported file type", zap.String("path", path))
+			return nil
+		}
+
+		// Resolve symlink targets
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %w", path, err)
+			}
+		}
+
 		// Create tar header
-		header, err := tar.FileInfoHeader(info, relPath)
+		header, err := tar.FileInfoHeader(info, link)
 		if err != nil {
 			return fmt.Errorf("failed to create tar header: %w", err)
 		}
@@ -87,78 +432,174 @@ func (s *Service) Create() (string, error) {
 			return fmt.Errorf("failed to write tar header: %w", err)
 		}
 
-		// If it's a regular file, copy its content
-		if info.Mode().IsRegular() {
+		entry := FileEntry{
+			Path:     relPath,
+			Mode:     fmt.Sprintf("%04o", info.Mode().Perm()),
+			ModTime:  info.ModTime(),
+			Linkname: link,
+		}
+
+		switch {
+		case info.IsDir():
+			entry.Type = EntryDir
+		case link != "":
+			entry.Type = EntrySymlink
+		default:
+			// Copy file content while hashing it
 			file, err := os.Open(path)
 			if err != nil {
 				return fmt.Errorf("failed to open file %s: %w", path, err)
 			}
 			defer file.Close()
 
-			if _, err := io.Copy(tarWriter, file); err != nil {
+			fileWriter := newHashWriter(tarWriter)
+			if _, err := io.Copy(fileWriter, storage.NewContextReader(ctx, file)); err != nil {
 				return fmt.Errorf("failed to copy file %s: %w", path, err)
 			}
+
+			entry.Type = EntryFile
+			entry.Size = fileWriter.size
+			entry.SHA256 = fileWriter.Sum()
+			s.archivedBytes.Add(fileWriter.size)
 		}
 
+		files = append(files, entry)
+		s.archivedFiles.Add(1)
 		return nil
 	})
 
 	if err != nil {
-		return "", fmt.Errorf("failed to create tar archive: %w", err)
+		// Release compressor workers, the output is discarded anyway
+		compressor.Close()
+		return nil, err
 	}
 
-	// Get file size
-	fileInfo, err := file.Stat()
+	// Flush tar and compressor trailers
+	if err := tarWriter.Close(); err != nil {
+		compressor.Close()
+		return nil, fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close compressor: %w", err)
+	}
+
+	return files, nil
+}
+
+// queryMetadata captures the latest block of the node through its RPC endpoint
+func (s *Service) queryMetadata(ctx context.Context, required bool) (*Metadata, error) {
+	meta := &Metadata{
+		ChainID:   s.cfg.Node.ChainID,
+		CreatedAt: time.Now(),
+	}
+
+	if s.cfg.Node.RPCEndpoint == "" {
+		if required {
+			return nil, fmt.Errorf("snapshot metadata requires node.rpc_endpoint")
+		}
+		s.logger.Warn("No RPC endpoint configured, snapshot height will be unknown")
+		return meta, nil
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+
+	// A stopped node can't answer, its data is still worth archiving
+	status, err := rpc.NewClient(s.cfg.Node.RPCEndpoint, rpcTimeout).Status(queryCtx)
 	if err != nil {
-		return "", fmt.Errorf("failed to get file info: %w", err)
+		if required || ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to query node status: %w", err)
+		}
+		s.logger.Warn("Failed to query node status, snapshot height will be unknown", zap.Error(err))
+		return meta, nil
 	}
 
-	s.logger.Info("Snapshot created successfully",
-		zap.String("path", snapshotPath),
-		zap.Int64("size_bytes", fileInfo.Size()),
-		zap.String("chain_id", s.cfg.Node.ChainID))
+	if status.NodeInfo.Network != "" && status.NodeInfo.Network != s.cfg.Node.ChainID {
+		return nil, fmt.Errorf("node reports network %s, expected %s", status.NodeInfo.Network, s.cfg.Node.ChainID)
+	}
 
-	return snapshotPath, nil
+	meta.Network = status.NodeInfo.Network
+	meta.NodeVersion = status.NodeInfo.Version
+	meta.Height = status.SyncInfo.LatestBlockHeight
+	meta.BlockHash = status.SyncInfo.LatestBlockHash
+	meta.AppHash = status.SyncInfo.LatestAppHash
+	meta.BlockTime = status.SyncInfo.LatestBlockTime
+
+	s.logger.Info("Captured node status",
+		zap.String("network", meta.Network),
+		zap.Int64("height", meta.Height),
+		zap.String("app_hash", meta.AppHash))
+
+	return meta, nil
+}
+
+// Cleanup removes old snapshots based on the local retention policy
+func (s *Service) Cleanup(ctx context.Context) error {
+	_, err := s.Prune(ctx, false)
+	return err
 }
 
-// Cleanup removes old snapshots based on retention policy
-func (s *Service) Cleanup() error {
+// Prune applies the local retention policy to this chain's archives in the
+// snapshot directory and removes files abandoned by crashed runs. It returns
+// the decision for every archive; with dryRun nothing is removed. Archives that
+// could not be removed are reported as kept.
+func (s *Service) Prune(ctx context.Context, dryRun bool) ([]retention.Decision, error) {
 	s.logger.Info("Cleaning up old snapshots",
-		zap.Int("retention", s.cfg.Snapshot.Retention))
+		zap.Any("retention", s.cfg.Snapshot.LocalRetention),
+		zap.Bool("dry_run", dryRun))
 
-	// List all snapshot files
-	files, err := os.ReadDir(s.cfg.GetSnapshotPath())
+	snapshots, abandoned, err := s.scan()
 	if err != nil {
-		return fmt.Errorf("failed to read snapshot directory: %w", err)
+		return nil, err
 	}
 
-	// Sort files by modification time (oldest first)
-	var snapshotFiles []os.FileInfo
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".gz" {
-			info, err := file.Info()
-			if err != nil {
-				s.logger.Warn("Failed to get file info", zap.String("file", file.Name()), zap.Error(err))
-				continue
-			}
-			snapshotFiles = append(snapshotFiles, info)
+	// Archives still waiting for an upload are kept
+	var items []retention.Item
+	var pending []retention.Decision
+	for _, snap := range snapshots {
+		item := retention.Item{
+			Key:    filepath.Base(snap.Path),
+			Time:   snap.Time,
+			Height: snap.Height,
+			Size:   snap.Size,
 		}
+		if snap.Pending {
+			pending = append(pending, retention.Decision{Item: item, Keep: true, Reason: "upload pending"})
+			continue
+		}
+		items = append(items, item)
 	}
 
-	// Remove files beyond retention limit
-	if len(snapshotFiles) > s.cfg.Snapshot.Retention {
-		filesToRemove := len(snapshotFiles) - s.cfg.Snapshot.Retention
-		for i := 0; i < filesToRemove; i++ {
-			filePath := filepath.Join(s.cfg.GetSnapshotPath(), snapshotFiles[i].Name())
-			if err := os.Remove(filePath); err != nil {
-				s.logger.Error("Failed to remove old snapshot",
-					zap.String("file", filePath),
-					zap.Error(err))
-			} else {
-				s.logger.Info("Removed old snapshot", zap.String("file", filePath))
-			}
+	decisions := append(retention.Plan(s.cfg.Snapshot.LocalRetention, items, time.Now()), pending...)
+	decisions = append(decisions, abandoned...)
+
+	if dryRun {
+		return decisions, nil
+	}
+
+	// Remove archives the policy does not keep
+	for i, decision := range decisions {
+		if decision.Keep {
+			continue
 		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		filePath := filepath.Join(s.cfg.GetSnapshotPath(), decision.Key)
+		if err := s.removeArchive(decision.Key); err != nil {
+			s.logger.Error("Failed to remove old snapshot",
+				zap.String("file", filePath),
+				zap.Error(err))
+			decisions[i].Keep = true
+			decisions[i].Reason = "removal failed"
+			continue
+		}
+		s.logger.Info("Removed old snapshot",
+			zap.String("file", filePath),
+			zap.String("reason", decision.Reason))
 	}
 
-	return nil
+	return decisions, nil
 }
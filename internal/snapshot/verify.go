@@ -0,0 +1,125 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Verify re-reads a finished archive and checks it against its manifest. The
+// whole stream is decompressed, so truncated or corrupt archives are detected.
+// It stops early when ctx is cancelled.
+func (s *Service) Verify(ctx context.Context, archivePath string) error {
+	s.logger.Info("Verifying snapshot", zap.String("path", archivePath))
+
+	manifest, err := ReadManifest(archivePath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+
+	// Hash the raw archive bytes while decompressing
+	archiveHash := newHashWriter(io.Discard)
+	archiveReader := io.TeeReader(storage.NewContextReader(ctx, file), archiveHash)
+
+	tarSource, _, err := newDecompressor(archiveReader)
+	if err != nil {
+		return err
+	}
+	defer tarSource.Close()
+
+	tarReader := tar.NewReader(tarSource)
+
+	var count int
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry %d: %w", count, err)
+		}
+
+		if count >= len(manifest.Files) {
+			return fmt.Errorf("archive has more entries than manifest (%d)", len(manifest.Files))
+		}
+		if err := verifyEntry(tarReader, header, &manifest.Files[count]); err != nil {
+			return err
+		}
+		count++
+	}
+
+	if count != len(manifest.Files) {
+		return fmt.Errorf("archive has %d entries, manifest lists %d", count, len(manifest.Files))
+	}
+
+	// Drain the rest so trailers and checksums are validated
+	if _, err := io.Copy(io.Discard, tarSource); err != nil {
+		return fmt.Errorf("failed to read archive trailer: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, archiveReader); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	if archiveHash.size != manifest.Archive.Size {
+		return fmt.Errorf("archive size %d does not match manifest size %d", archiveHash.size, manifest.Archive.Size)
+	}
+	if sum := archiveHash.Sum(); sum != manifest.Archive.SHA256 {
+		return fmt.Errorf("archive sha256 %s does not match manifest %s", sum, manifest.Archive.SHA256)
+	}
+
+	s.logger.Info("Snapshot verified successfully",
+		zap.String("path", archivePath),
+		zap.Int("files", count),
+		zap.Int64("size_bytes", archiveHash.size))
+
+	return nil
+}
+
+// verifyEntry checks a single tar entry against its manifest record
+func verifyEntry(r io.Reader, header *tar.Header, entry *FileEntry) error {
+	if filepath.Clean(header.Name) != entry.Path {
+		return fmt.Errorf("unexpected entry %s, manifest expects %s", header.Name, entry.Path)
+	}
+
+	switch entry.Type {
+	case EntryDir:
+		if header.Typeflag != tar.TypeDir {
+			return fmt.Errorf("entry %s is not a directory", entry.Path)
+		}
+	case EntrySymlink:
+		if header.Typeflag != tar.TypeSymlink || header.Linkname != entry.Linkname {
+			return fmt.Errorf("entry %s is not a symlink to %s", entry.Path, entry.Linkname)
+		}
+	case EntryFile:
+		if header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("entry %s is not a regular file", entry.Path)
+		}
+
+		fileHash := newHashWriter(io.Discard)
+		if _, err := io.Copy(fileHash, r); err != nil {
+			return fmt.Errorf("failed to read entry %s: %w", entry.Path, err)
+		}
+		if fileHash.size != entry.Size {
+			return fmt.Errorf("entry %s has size %d, manifest expects %d", entry.Path, fileHash.size, entry.Size)
+		}
+		if sum := fileHash.Sum(); sum != entry.SHA256 {
+			return fmt.Errorf("entry %s has sha256 %s, manifest expects %s", entry.Path, sum, entry.SHA256)
+		}
+	default:
+		return fmt.Errorf("entry %s has unknown type %s", entry.Path, entry.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	svc, root := newRestoreService(t)
+	svc.cfg.Node.ChainID = "test-1"
+	svc.cfg.Snapshot.TempDir = filepath.Join(root, "tmp")
+	svc.cfg.Snapshot.Compression = string(FormatGzip)
+
+	dataPath := svc.cfg.GetNodeDataPath()
+	if err := os.MkdirAll(filepath.Join(dataPath, "db"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataPath, "db", "000001.ldb"), []byte("block data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	path, err := svc.Create(ctx, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.Verify(ctx, path); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := svc.Verify(cancelled, path); !errors.Is(err, context.Canceled) {
+		t.Errorf("Verify() with a cancelled context = %v", err)
+	}
+
+	// A truncated archive no longer matches its manifest
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Verify(ctx, path); err == nil {
+		t.Error("Verify() accepted a truncated archive")
+	}
+
+	// Removing it takes the sidecars along
+	if err := svc.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if leftovers, _ := filepath.Glob(path + "*"); len(leftovers) != 0 {
+		t.Errorf("leftovers = %v", leftovers)
+	}
+}
@@ -0,0 +1,35 @@
+package backend
+
+import (
+	"fmt"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/s3"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"github.com/q163i/snapshot-cosmos/internal/storage/local"
+	"github.com/q163i/snapshot-cosmos/internal/storage/sftp"
+	"go.uber.org/zap"
+)
+
+// New creates the storage backend configured for a node
+func New(cfg *config.NodeConfig, logger *zap.Logger) (storage.Backend, error) {
+	switch cfg.Storage.Type {
+	case "", config.StorageS3:
+		return s3.NewService(cfg, logger), nil
+	case config.StorageLocal:
+		return local.NewService(cfg, logger), nil
+	case config.StorageSFTP:
+		return sftp.NewService(cfg, logger), nil
+	default:
+		return nil, fmt.Errorf("unsupported storage type: %s", cfg.Storage.Type)
+	}
+}
+
+// NewDestination creates the storage backend of one of a node's upload destinations
+func NewDestination(cfg *config.NodeConfig, dest config.DestinationConfig, logger *zap.Logger) (storage.Backend, error) {
+	destCfg := *cfg
+	destCfg.S3 = dest.S3
+	destCfg.Storage = dest.StorageConfig
+
+	return New(&destCfg, logger.With(zap.String("destination", dest.Name)))
+}
@@ -0,0 +1,348 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"go.uber.org/zap"
+)
+
+// partialSuffix marks files that are still being written
+const partialSuffix = ".partial"
+
+// Service stores snapshots in a local or network mounted directory
+type Service struct {
+	cfg    *config.NodeConfig
+	logger *zap.Logger
+}
+
+// Service is a storage backend that can clean up unfinished uploads
+var (
+	_ storage.Backend       = (*Service)(nil)
+	_ storage.UploadCleaner = (*Service)(nil)
+)
+
+// NewService creates a new local storage service
+func NewService(cfg *config.NodeConfig, logger *zap.Logger) *Service {
+	return &Service{
+		cfg:    cfg,
+		logger: logger,
+	}
+}
+
+// Upload copies a snapshot file and its sidecar files into the storage directory
+func (s *Service) Upload(ctx context.Context, filePath, key string) error {
+	if err := s.putFile(ctx, filePath, key); err != nil {
+		return err
+	}
+
+	return s.UploadSidecars(ctx, filePath, key)
+}
+
+// UploadSidecars copies the sidecar files of a local snapshot next to key
+func (s *Service) UploadSidecars(ctx context.Context, filePath, key string) error {
+	for _, sidecar := range snapshot.Sidecars(filePath) {
+		if _, err := os.Stat(sidecar); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := s.putFile(ctx, sidecar, key+strings.TrimPrefix(sidecar, filePath)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putFile copies a single file to key
+func (s *Service) putFile(ctx context.Context, filePath, key string) error {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer src.Close()
+
+	s.logger.Info("Copying file to local storage",
+		zap.String("file", filePath),
+		zap.String("key", key),
+		zap.String("storage_path", s.cfg.Storage.Path))
+
+	w, err := s.NewWriter(ctx, key, "")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, storage.NewContextReader(ctx, src)); err != nil {
+		return w.CloseWithError(fmt.Errorf("failed to copy file: %w", err))
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	s.logger.Info("File copied successfully",
+		zap.String("file", filePath),
+		zap.String("key", key))
+
+	return nil
+}
+
+// NewWriter creates key under a temporary name that is renamed into place on Close
+func (s *Service) NewWriter(ctx context.Context, key, contentType string) (storage.Writer, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	file, err := os.Create(target + partialSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	return &fileWriter{file: file, target: target}, nil
+}
+
+// Download copies a stored object into a local file
+func (s *Service) Download(ctx context.Context, key, localPath string) error {
+	src, err := s.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return fmt.Errorf("failed to create local directory: %w", err)
+	}
+
+	s.logger.Info("Copying file from local storage",
+		zap.String("key", key),
+		zap.String("local_path", localPath))
+
+	partialPath := localPath + partialSuffix
+	w := &fileWriter{target: localPath}
+	if w.file, err = os.Create(partialPath); err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+
+	if _, err := io.Copy(w, storage.NewContextReader(ctx, src)); err != nil {
+		return w.CloseWithError(fmt.Errorf("failed to copy file: %w", err))
+	}
+
+	return w.Close()
+}
+
+// Open opens a stored object for reading
+func (s *Service) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+		}
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	return file, nil
+}
+
+// List returns the files under prefix, skipping files that are still being written
+func (s *Service) List(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	// Only walk the directory the prefix points into
+	dir, err := s.path(path.Dir(prefix + "x"))
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []storage.ObjectInfo
+	err = filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), partialSuffix) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(s.cfg.Storage.Path, filePath)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(relPath)
+		if !strings.HasPrefix(key, strings.TrimPrefix(prefix, "/")) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, storage.ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage directory: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+// Stat returns the size and modification time of a stored object
+func (s *Service) Stat(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+		}
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	return &storage.ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// Delete removes a stored object
+func (s *Service) Delete(ctx context.Context, key string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Deleting file from local storage", zap.String("key", key))
+
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	return nil
+}
+
+// AbortStaleUploads removes partially written files under prefix left behind
+// by interrupted uploads and not modified for olderThan. Local uploads are not
+// resumable, so no journal applies.
+func (s *Service) AbortStaleUploads(ctx context.Context, prefix, journalDir string, olderThan time.Duration) error {
+	dir, err := s.path(path.Dir(prefix + "x"))
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), partialSuffix) {
+			return nil
+		}
+
+		// A recently written file may belong to an upload in progress
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < olderThan {
+			return nil
+		}
+
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("failed to remove partial file: %w", err)
+		}
+
+		s.logger.Info("Removed stale partial file", zap.String("file", filePath))
+		return nil
+	})
+}
+
+// path maps a key onto a file below the storage directory
+func (s *Service) path(key string) (string, error) {
+	root := filepath.Clean(s.cfg.Storage.Path)
+	target := filepath.Join(root, filepath.FromSlash(key))
+	if target != root && !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("key outside storage directory: %s", key)
+	}
+	return target, nil
+}
+
+// fileWriter writes to a temporary file and renames it to target on Close
+type fileWriter struct {
+	file   *os.File
+	target string
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// Close flushes the file to disk and moves it into place
+func (w *fileWriter) Close() error {
+	if err := w.file.Sync(); err != nil {
+		return w.CloseWithError(fmt.Errorf("failed to sync file: %w", err))
+	}
+
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if err := os.Rename(w.file.Name(), w.target); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+
+	return nil
+}
+
+// CloseWithError discards the temporary file and returns err
+func (w *fileWriter) CloseWithError(err error) error {
+	w.file.Close()
+	os.Remove(w.file.Name())
+
+	if err == nil {
+		err = errors.New("write aborted")
+	}
+	return err
+}
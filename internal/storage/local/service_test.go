@@ -0,0 +1,243 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"go.uber.org/zap"
+)
+
+// newTestService returns a service storing below a temporary directory
+func newTestService(t *testing.T) (*Service, string) {
+	t.Helper()
+
+	root := filepath.Join(t.TempDir(), "store")
+	cfg := &config.NodeConfig{}
+	cfg.Storage.Type = config.StorageLocal
+	cfg.Storage.Path = root
+
+	return NewService(cfg, zap.NewNop()), root
+}
+
+// writeFiles creates files below dir with their name as content
+func writeFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	svc, root := newTestService(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test-1-snapshot-100-20240501-100000.tar")
+	writeFiles(t, dir, filepath.Base(path), filepath.Base(path)+snapshot.MetadataSuffix)
+
+	if err := svc.Upload(context.Background(), path, "node/archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if got, want := strings.Join(names, ","), "archive.tar,archive.tar"+snapshot.MetadataSuffix; got != want {
+		t.Errorf("stored files = %s, want %s", got, want)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "node", "archive.tar"))
+	if err != nil || string(data) != filepath.Base(path) {
+		t.Errorf("stored archive = %q, %v", data, err)
+	}
+
+	// A cancelled upload leaves nothing behind
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := svc.Upload(ctx, path, "node/cancelled.tar"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled Upload() = %v, want context.Canceled", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(root, "node", "cancelled.tar*")); len(matches) != 0 {
+		t.Errorf("cancelled upload left %v behind", matches)
+	}
+}
+
+func TestList(t *testing.T) {
+	svc, root := newTestService(t)
+	writeFiles(t, root,
+		"node/b.tar",
+		"node/a.tar",
+		"node/a.tar"+snapshot.MetadataSuffix,
+		"node/c.tar"+partialSuffix,
+		"node-other/d.tar",
+		"other/e.tar",
+	)
+
+	objects, err := svc.List(context.Background(), "node/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	want := "node/a.tar,node/a.tar" + snapshot.MetadataSuffix + ",node/b.tar"
+	if got := strings.Join(keys, ","); got != want {
+		t.Errorf("List() = %s, want %s", got, want)
+	}
+	if objects[0].Size != int64(len("node/a.tar")) {
+		t.Errorf("size of node/a.tar = %d", objects[0].Size)
+	}
+
+	// A prefix ending within a name matches on the name
+	objects, err = svc.List(context.Background(), "node/a")
+	if err != nil || len(objects) != 2 {
+		t.Errorf("List(node/a) = %+v, %v", objects, err)
+	}
+
+	// A missing directory is empty
+	objects, err = svc.List(context.Background(), "missing/")
+	if err != nil || len(objects) != 0 {
+		t.Errorf("List(missing/) = %+v, %v", objects, err)
+	}
+}
+
+func TestStatOpenAndDelete(t *testing.T) {
+	svc, root := newTestService(t)
+	writeFiles(t, root, "node/a.tar")
+	ctx := context.Background()
+
+	info, err := svc.Stat(ctx, "node/a.tar")
+	if err != nil || info.Size != int64(len("node/a.tar")) {
+		t.Fatalf("Stat() = %+v, %v", info, err)
+	}
+
+	r, err := svc.Open(ctx, "node/a.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "node/a.tar" {
+		t.Errorf("Open() read %q, %v", data, err)
+	}
+
+	if err := svc.Delete(ctx, "node/a.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Stat(ctx, "node/a.tar"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Stat() after Delete() = %v, want ErrNotFound", err)
+	}
+	if _, err := svc.Open(ctx, "node/a.tar"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Open() after Delete() = %v, want ErrNotFound", err)
+	}
+
+	// Deleting a missing object is not an error
+	if err := svc.Delete(ctx, "node/a.tar"); err != nil {
+		t.Errorf("Delete() of a missing object = %v", err)
+	}
+}
+
+func TestPathEscape(t *testing.T) {
+	svc, root := newTestService(t)
+	writeFiles(t, filepath.Dir(root), "secret", "store-other/file")
+	ctx := context.Background()
+
+	for _, key := range []string{"../secret", "node/../../secret", "../store-other/file"} {
+		if _, err := svc.Stat(ctx, key); err == nil || errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Stat(%s) = %v, want an escape error", key, err)
+		}
+		if err := svc.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%s) succeeded", key)
+		}
+		if _, err := svc.NewWriter(ctx, key, ""); err == nil {
+			t.Errorf("NewWriter(%s) succeeded", key)
+		}
+		if _, err := svc.List(ctx, key+"/"); err == nil {
+			t.Errorf("List(%s/) succeeded", key)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "secret")); err != nil {
+		t.Errorf("file outside the storage directory is gone: %v", err)
+	}
+
+	// Keys that stay inside after cleaning are fine
+	if _, err := svc.NewWriter(ctx, "node/../a.tar", ""); err != nil {
+		t.Errorf("NewWriter(node/../a.tar) = %v", err)
+	}
+}
+
+func TestWriterCloseWithError(t *testing.T) {
+	svc, root := newTestService(t)
+
+	w, err := svc.NewWriter(context.Background(), "node/a.tar", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "partial"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseWithError(nil); err == nil {
+		t.Error("CloseWithError(nil) returned nil")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("aborted write left %s behind", entries[0].Name())
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	svc, root := newTestService(t)
+	writeFiles(t, root,
+		"node/stale.tar"+partialSuffix,
+		"node/recent.tar"+partialSuffix,
+		"node/done.tar",
+		"other/stale.tar"+partialSuffix,
+	)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"node/stale.tar" + partialSuffix, "node/done.tar", "other/stale.tar" + partialSuffix} {
+		if err := os.Chtimes(filepath.Join(root, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := svc.AbortStaleUploads(context.Background(), "node/", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]bool{
+		"node/stale.tar" + partialSuffix:  false,
+		"node/recent.tar" + partialSuffix: true,
+		"node/done.tar":                   true,
+		"other/stale.tar" + partialSuffix: true,
+	} {
+		if _, err := os.Stat(filepath.Join(root, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, want)
+		}
+	}
+}
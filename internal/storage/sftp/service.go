@@ -0,0 +1,588 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sftpclient "github.com/pkg/sftp"
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// partialSuffix marks remote files that are still being uploaded
+	partialSuffix = ".partial"
+	// defaultPort is the SSH port used when the host has none
+	defaultPort = "22"
+	// dialTimeout bounds establishing the SSH connection
+	dialTimeout = 30 * time.Second
+)
+
+// Service stores snapshots on an SFTP server
+type Service struct {
+	cfg    *config.NodeConfig
+	logger *zap.Logger
+	// shared is the connection of a session, nil outside of one
+	shared *connection
+}
+
+// Service is a storage backend that can clean up unfinished uploads and share
+// a connection across operations
+var (
+	_ storage.Backend       = (*Service)(nil)
+	_ storage.UploadCleaner = (*Service)(nil)
+	_ storage.SessionOpener = (*Service)(nil)
+)
+
+// NewService creates a new SFTP storage service
+func NewService(cfg *config.NodeConfig, logger *zap.Logger) *Service {
+	return &Service{
+		cfg:    cfg,
+		logger: logger,
+	}
+}
+
+// OpenSession connects to the SFTP server once for every operation made through
+// the returned session
+func (s *Service) OpenSession(ctx context.Context) (storage.Session, error) {
+	return s.openSession(ctx)
+}
+
+// openSession returns a service whose operations share one connection
+func (s *Service) openSession(ctx context.Context) (*Service, error) {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Service{cfg: s.cfg, logger: s.logger, shared: conn}, nil
+}
+
+// Close closes the connection of a session, it does nothing otherwise
+func (s *Service) Close() error {
+	if s.shared == nil {
+		return nil
+	}
+	return s.shared.Close()
+}
+
+// withSession runs fn on a service sharing one connection, the current one
+// within a session
+func (s *Service) withSession(ctx context.Context, fn func(session *Service) error) error {
+	if s.shared != nil {
+		return fn(s)
+	}
+
+	session, err := s.openSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return fn(session)
+}
+
+// Upload uploads a snapshot file and its sidecar files to the SFTP server over
+// a single connection
+func (s *Service) Upload(ctx context.Context, filePath, key string) error {
+	return s.withSession(ctx, func(session *Service) error {
+		if err := session.putFile(ctx, filePath, key); err != nil {
+			return err
+		}
+
+		return session.UploadSidecars(ctx, filePath, key)
+	})
+}
+
+// UploadSidecars uploads the sidecar files of a local snapshot next to key
+func (s *Service) UploadSidecars(ctx context.Context, filePath, key string) error {
+	return s.withSession(ctx, func(session *Service) error {
+		for _, sidecar := range snapshot.Sidecars(filePath) {
+			if _, err := os.Stat(sidecar); os.IsNotExist(err) {
+				continue
+			}
+
+			if err := session.putFile(ctx, sidecar, key+strings.TrimPrefix(sidecar, filePath)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// putFile uploads a single file to key
+func (s *Service) putFile(ctx context.Context, filePath, key string) error {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer src.Close()
+
+	s.logger.Info("Uploading file over SFTP",
+		zap.String("file", filePath),
+		zap.String("key", key),
+		zap.String("host", s.cfg.Storage.SFTP.Host))
+
+	w, err := s.NewWriter(ctx, key, "")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, src); err != nil {
+		return w.CloseWithError(fmt.Errorf("failed to upload file: %w", err))
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	s.logger.Info("File uploaded successfully",
+		zap.String("file", filePath),
+		zap.String("key", key))
+
+	return nil
+}
+
+// NewWriter uploads to a temporary remote name that is renamed to key on Close
+func (s *Service) NewWriter(ctx context.Context, key, contentType string) (storage.Writer, error) {
+	target, err := s.remotePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.MkdirAll(path.Dir(target)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create remote directory: %w", err)
+	}
+
+	file, err := conn.Create(target + partialSuffix)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create remote file: %w", err)
+	}
+
+	return &remoteWriter{conn: conn, file: file, target: target}, nil
+}
+
+// Download fetches a remote file into a local file
+func (s *Service) Download(ctx context.Context, key, localPath string) error {
+	src, err := s.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return fmt.Errorf("failed to create local directory: %w", err)
+	}
+
+	s.logger.Info("Downloading file over SFTP",
+		zap.String("key", key),
+		zap.String("local_path", localPath))
+
+	partialPath := localPath + partialSuffix
+	file, err := os.Create(partialPath)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+
+	if _, err := io.Copy(file, src); err != nil {
+		file.Close()
+		os.Remove(partialPath)
+		return fmt.Errorf("failed to download file: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(partialPath)
+		return fmt.Errorf("failed to close local file: %w", err)
+	}
+
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return fmt.Errorf("failed to move download into place: %w", err)
+	}
+
+	return nil
+}
+
+// Open opens a remote file for streaming reads. The caller must close the returned reader.
+func (s *Service) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	target, err := s.remotePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := conn.Open(target)
+	if err != nil {
+		conn.Close()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+		}
+		return nil, fmt.Errorf("failed to open remote file: %w", err)
+	}
+
+	return &remoteReader{conn: conn, file: file}, nil
+}
+
+// List returns the remote files under prefix, skipping unfinished uploads
+func (s *Service) List(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	dir, err := s.remotePath(path.Dir(prefix + "x"))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var objects []storage.ObjectInfo
+	walker := conn.Walk(dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list remote directory: %w", err)
+		}
+
+		info := walker.Stat()
+		if info.IsDir() || strings.HasSuffix(walker.Path(), partialSuffix) {
+			continue
+		}
+
+		key := s.keyFor(walker.Path())
+		if !strings.HasPrefix(key, strings.TrimPrefix(prefix, "/")) {
+			continue
+		}
+
+		objects = append(objects, storage.ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+// Stat returns the size and modification time of a remote file
+func (s *Service) Stat(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	target, err := s.remotePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	info, err := conn.Stat(target)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+		}
+		return nil, fmt.Errorf("failed to stat remote file: %w", err)
+	}
+
+	return &storage.ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// Delete removes a remote file
+func (s *Service) Delete(ctx context.Context, key string) error {
+	target, err := s.remotePath(key)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.logger.Info("Deleting file over SFTP", zap.String("key", key))
+
+	if err := conn.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete remote file: %w", err)
+	}
+
+	return nil
+}
+
+// AbortStaleUploads removes temporary files under prefix left behind by
+// interrupted uploads and not modified for olderThan. SFTP uploads are not
+// resumable, so no journal applies.
+func (s *Service) AbortStaleUploads(ctx context.Context, prefix, journalDir string, olderThan time.Duration) error {
+	dir, err := s.remotePath(path.Dir(prefix + "x"))
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var errs []error
+	walker := conn.Walk(dir)
+	for walker.Step() {
+		if walker.Err() != nil || walker.Stat().IsDir() || !strings.HasSuffix(walker.Path(), partialSuffix) {
+			continue
+		}
+
+		// A recently written file may belong to an upload in progress
+		if time.Since(walker.Stat().ModTime()) < olderThan {
+			continue
+		}
+
+		if err := conn.Remove(walker.Path()); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", walker.Path(), err))
+			continue
+		}
+
+		s.logger.Info("Removed stale partial upload", zap.String("path", walker.Path()))
+	}
+
+	return errors.Join(errs...)
+}
+
+// connect opens an SFTP session authenticated with the configured key and
+// verified against the known_hosts file, or borrows the connection of the
+// current session. Cancelling ctx closes the connection, which interrupts
+// transfers in progress.
+func (s *Service) connect(ctx context.Context) (*connection, error) {
+	if s.shared != nil {
+		shared := s.shared
+		return &connection{
+			Client:   shared.Client,
+			ssh:      shared.ssh,
+			stop:     context.AfterFunc(ctx, func() { shared.ssh.Close() }),
+			borrowed: true,
+		}, nil
+	}
+
+	sftpCfg := s.cfg.Storage.SFTP
+
+	// Load private key
+	keyData, err := os.ReadFile(sftpCfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+	}
+
+	// Verify the server against known_hosts
+	knownHostsFile := sftpCfg.KnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate known_hosts: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+	}
+
+	addr := sftpCfg.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	stop := context.AfterFunc(ctx, func() { netConn.Close() })
+
+	// The handshake gets the same time limit as the dial
+	netConn.SetDeadline(time.Now().Add(dialTimeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, &ssh.ClientConfig{
+		User:            sftpCfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		stop()
+		netConn.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	netConn.SetDeadline(time.Time{})
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+
+	client, err := sftpclient.NewClient(sshClient)
+	if err != nil {
+		stop()
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+
+	return &connection{Client: client, ssh: sshClient, stop: stop}, nil
+}
+
+// remotePath maps a key onto a path below the remote directory
+func (s *Service) remotePath(key string) (string, error) {
+	cleanKey := path.Clean(strings.TrimPrefix(key, "/"))
+	if cleanKey == ".." || strings.HasPrefix(cleanKey, "../") {
+		return "", fmt.Errorf("key outside remote directory: %s", key)
+	}
+	return path.Join(s.root(), cleanKey), nil
+}
+
+// keyFor maps a remote path back onto its key
+func (s *Service) keyFor(remotePath string) string {
+	root := s.root()
+	if root == "." {
+		return remotePath
+	}
+	return strings.TrimPrefix(remotePath, root+"/")
+}
+
+// root returns the remote directory, relative to the login directory if not absolute
+func (s *Service) root() string {
+	if s.cfg.Storage.SFTP.RemoteDir == "" {
+		return "."
+	}
+	return path.Clean(s.cfg.Storage.SFTP.RemoteDir)
+}
+
+// connection is an SFTP session together with its SSH connection
+type connection struct {
+	*sftpclient.Client
+	ssh *ssh.Client
+	// stop detaches the connection from the context it was opened with
+	stop func() bool
+	// borrowed is set for the connection of a session, which stays open
+	borrowed bool
+}
+
+// Close closes the SFTP session and the SSH connection, unless they belong to a
+// session
+func (c *connection) Close() error {
+	c.stop()
+	if c.borrowed {
+		return nil
+	}
+	err := c.Client.Close()
+	if sshErr := c.ssh.Close(); err == nil {
+		err = sshErr
+	}
+	return err
+}
+
+// remoteWriter uploads to a temporary file that is renamed to target on Close
+type remoteWriter struct {
+	conn   *connection
+	file   *sftpclient.File
+	target string
+}
+
+func (w *remoteWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// ReadFrom uploads r with concurrent writes
+func (w *remoteWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.file.ReadFrom(r)
+}
+
+// Close finishes the upload and moves the file into place
+func (w *remoteWriter) Close() error {
+	defer w.conn.Close()
+
+	tmpPath := w.file.Name()
+	if err := w.file.Close(); err != nil {
+		w.conn.Remove(tmpPath)
+		return fmt.Errorf("failed to close remote file: %w", err)
+	}
+
+	// Prefer an atomic rename, plain SFTP rename fails if the target exists
+	if err := w.conn.PosixRename(tmpPath, w.target); err != nil {
+		if err := w.conn.Remove(w.target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			w.conn.Remove(tmpPath)
+			return fmt.Errorf("failed to replace remote file: %w", err)
+		}
+		if err := w.conn.Rename(tmpPath, w.target); err != nil {
+			w.conn.Remove(tmpPath)
+			return fmt.Errorf("failed to move remote file into place: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CloseWithError removes the temporary file and returns err
+func (w *remoteWriter) CloseWithError(err error) error {
+	defer w.conn.Close()
+
+	w.file.Close()
+	w.conn.Remove(w.file.Name())
+
+	if err == nil {
+		err = errors.New("upload aborted")
+	}
+	return err
+}
+
+// remoteReader reads a remote file and closes its connection on Close
+type remoteReader struct {
+	conn *connection
+	file *sftpclient.File
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	return r.file.Read(p)
+}
+
+// WriteTo downloads the file with concurrent reads
+func (r *remoteReader) WriteTo(w io.Writer) (int64, error) {
+	return r.file.WriteTo(w)
+}
+
+// Close closes the file and the connection
+func (r *remoteReader) Close() error {
+	r.file.Close()
+	return r.conn.Close()
+}
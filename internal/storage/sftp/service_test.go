@@ -0,0 +1,343 @@
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sftpserver "github.com/pkg/sftp"
+	"github.com/q163i/snapshot-cosmos/internal/config"
+	"github.com/q163i/snapshot-cosmos/internal/snapshot"
+	"github.com/q163i/snapshot-cosmos/internal/storage"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is an in-process SFTP server serving the local file system
+type testServer struct {
+	addr string
+	// connections counts the SSH connections accepted so far
+	connections atomic.Int32
+}
+
+// newTestService starts an SFTP server and returns a service storing below a
+// temporary remote directory on it
+func newTestService(t *testing.T) (*Service, *testServer, string) {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "snapshots" || string(key.Marshal()) != string(authorized.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	serverCfg.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testServer{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.connections.Add(1)
+			go serveSSH(conn, serverCfg)
+		}
+	}()
+
+	// Client key and known_hosts
+	dir := t.TempDir()
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.addr)}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteDir := filepath.Join(t.TempDir(), "remote")
+	cfg := &config.NodeConfig{}
+	cfg.Storage.Type = config.StorageSFTP
+	cfg.Storage.SFTP.Host = server.addr
+	cfg.Storage.SFTP.User = "snapshots"
+	cfg.Storage.SFTP.KeyFile = keyFile
+	cfg.Storage.SFTP.KnownHosts = knownHosts
+	cfg.Storage.SFTP.RemoteDir = remoteDir
+
+	return NewService(cfg, zap.NewNop()), server, remoteDir
+}
+
+// serveSSH serves the sftp subsystem on an SSH connection
+func serveSSH(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftpserver.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				channel.Close()
+			}
+		}()
+	}
+}
+
+// writeSnapshot writes a local archive with both sidecars
+func writeSnapshot(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test-1-snapshot-100-20240501-100000.tar")
+	for _, file := range append([]string{path}, snapshot.Sidecars(path)...) {
+		if err := os.WriteFile(file, []byte(filepath.Base(file)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestUploadUsesOneConnection(t *testing.T) {
+	svc, server, remoteDir := newTestService(t)
+	path := writeSnapshot(t)
+
+	if err := svc.Upload(context.Background(), path, "node/archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.connections.Load(); got != 1 {
+		t.Errorf("upload opened %d connections, want 1", got)
+	}
+
+	for _, file := range append([]string{path}, snapshot.Sidecars(path)...) {
+		remote := filepath.Join(remoteDir, "node", "archive.tar"+strings.TrimPrefix(file, path))
+		data, err := os.ReadFile(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != filepath.Base(file) {
+			t.Errorf("%s holds %q", remote, data)
+		}
+		if _, err := os.Stat(remote + partialSuffix); !os.IsNotExist(err) {
+			t.Errorf("partial upload left behind for %s", remote)
+		}
+	}
+}
+
+func TestSessionSharesConnection(t *testing.T) {
+	svc, server, remoteDir := newTestService(t)
+	path := writeSnapshot(t)
+	ctx := context.Background()
+
+	session, err := storage.OpenSession(ctx, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A prune pass lists, stats and deletes over the session
+	for _, key := range []string{"node/a.tar", "node/b.tar"} {
+		if err := session.Upload(ctx, path, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, err := session.List(ctx, "node/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 6 {
+		t.Fatalf("listed %d objects, want 6: %+v", len(objects), objects)
+	}
+	for _, object := range objects {
+		if _, err := session.Stat(ctx, object.Key); err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Delete(ctx, object.Key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := server.connections.Load(); got != 1 {
+		t.Errorf("session opened %d connections, want 1", got)
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(remoteDir, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files left after deleting every object", len(entries))
+	}
+
+	// Outside the session every operation connects on its own
+	if _, err := svc.List(ctx, "node/"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.connections.Load(); got != 2 {
+		t.Errorf("connections after the session = %d, want 2", got)
+	}
+}
+
+func TestListStatAndOpen(t *testing.T) {
+	svc, _, remoteDir := newTestService(t)
+	ctx := context.Background()
+
+	files := map[string]string{
+		"node/a.tar":                 "archive",
+		"node/b.tar" + partialSuffix: "unfinished",
+		"other/c.tar":                "foreign",
+	}
+	for name, data := range files {
+		remote := filepath.Join(remoteDir, name)
+		if err := os.MkdirAll(filepath.Dir(remote), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(remote, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects, err := svc.List(ctx, "node/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "node/a.tar" || objects[0].Size != 7 {
+		t.Errorf("List() = %+v, want node/a.tar only", objects)
+	}
+
+	if _, err := svc.Stat(ctx, "node/missing.tar"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Stat() of a missing file = %v, want ErrNotFound", err)
+	}
+	if _, err := svc.Open(ctx, "node/missing.tar"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Open() of a missing file = %v, want ErrNotFound", err)
+	}
+
+	r, err := svc.Open(ctx, "node/a.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "archive" {
+		t.Errorf("Open() read %q, %v", data, err)
+	}
+
+	if _, err := svc.Stat(ctx, "../outside.tar"); err == nil {
+		t.Error("stat a key outside the remote directory")
+	}
+}
+
+func TestWriterCloseWithError(t *testing.T) {
+	svc, _, remoteDir := newTestService(t)
+
+	w, err := svc.NewWriter(context.Background(), "node/a.tar", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "partial"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseWithError(errors.New("archive failed")); err == nil {
+		t.Error("CloseWithError() returned nil")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(remoteDir, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("aborted upload left %s behind", entries[0].Name())
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	svc, _, remoteDir := newTestService(t)
+
+	dir := filepath.Join(remoteDir, "node")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"stale.tar" + partialSuffix, "recent.tar" + partialSuffix, "done.tar"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"stale.tar" + partialSuffix, "done.tar"} {
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := svc.AbortStaleUploads(context.Background(), "node/", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]bool{"stale.tar" + partialSuffix: false, "recent.tar" + partialSuffix: true, "done.tar": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when an object does not exist in storage
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// ETag is the entity tag of the object, empty for backends without one
+	ETag string
+	// Metadata holds user metadata; it is only filled in by Stat, and nil for
+	// backends without user metadata
+	Metadata map[string]string
+}
+
+// Writer streams a single object into storage. The object only becomes visible
+// once Close succeeds; CloseWithError discards everything written so far.
+type Writer interface {
+	io.WriteCloser
+	CloseWithError(err error) error
+}
+
+// Backend stores snapshot archives and their sidecar files under slash-separated
+// keys. Cancelling ctx stops an operation, including the network I/O of a Writer.
+type Backend interface {
+	// Upload stores a local snapshot file and its sidecar files under key
+	Upload(ctx context.Context, filePath, key string) error
+	// UploadSidecars stores the sidecar files of a local snapshot next to key
+	UploadSidecars(ctx context.Context, filePath, key string) error
+	// NewWriter starts streaming a new object to key
+	NewWriter(ctx context.Context, key, contentType string) (Writer, error)
+	// Download fetches an object into a local file
+	Download(ctx context.Context, key, localPath string) error
+	// Open opens an object for streaming reads
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the objects under prefix with their metadata, ordered by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Stat returns information about a single object
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Delete removes an object, deleting a missing object is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// UploadCleaner is implemented by backends that can leave unfinished uploads
+// behind after a crash
+type UploadCleaner interface {
+	// AbortStaleUploads discards unfinished uploads under prefix that started
+	// more than olderThan ago and that no journal in journalDir references.
+	// Younger uploads may belong to another process sharing the storage.
+	AbortStaleUploads(ctx context.Context, prefix, journalDir string, olderThan time.Duration) error
+}
+
+// Session is a backend that keeps its connection open across operations until
+// it is closed
+type Session interface {
+	Backend
+	io.Closer
+}
+
+// SessionOpener is implemented by backends that connect for every operation
+type SessionOpener interface {
+	// OpenSession connects once for every operation made through the session
+	OpenSession(ctx context.Context) (Session, error)
+}
+
+// OpenSession opens a session on backends that connect for every operation,
+// other backends are used as they are
+func OpenSession(ctx context.Context, b Backend) (Session, error) {
+	if opener, ok := b.(SessionOpener); ok {
+		return opener.OpenSession(ctx)
+	}
+	return nopSession{b}, nil
+}
+
+// nopSession is a backend without a connection to keep open
+type nopSession struct {
+	Backend
+}
+
+func (nopSession) Close() error {
+	return nil
+}
+
+// NewContextReader wraps r so that reads fail once ctx is cancelled
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+// contextReader checks for cancellation before every read
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}